@@ -0,0 +1,295 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// apiVersionPath returns the API versions a controller supports.  Older
+// controllers, which only have v1, do not have it.
+const apiVersionPath = "/api/version"
+
+type apiVersionResponse struct {
+	Version     string   `json:"version,omitempty"`
+	APIVersions []string `json:"apiVersions,omitempty"`
+}
+
+// controllerAPI is one version of the controller's API.  Responses are
+// converted to the v1 structs, which the rest of the manager uses.
+type controllerAPI interface {
+	version() string
+	agentsPath() string
+	parseAgents(data []byte) (connectedAgentsResponse, error)
+	credentialsPath() string
+	credentialsRequest(s controllerService) ([]byte, error)
+	parseCredentials(data []byte) (serviceURL string, cred ServiceCredential, err error)
+	eventsPath() string
+}
+
+// apiV1 is the original controller API.
+type apiV1 struct{}
+
+func (apiV1) version() string {
+	return APIVersionV1
+}
+
+func (apiV1) agentsPath() string {
+	return "/api/v1/getAgentStatistics"
+}
+
+func (apiV1) parseAgents(data []byte) (connectedAgentsResponse, error) {
+	var ca connectedAgentsResponse
+	if err := json.Unmarshal(data, &ca); err != nil {
+		return connectedAgentsResponse{}, fmt.Errorf("cannot decode connected agent JSON: %v", err)
+	}
+	return ca, nil
+}
+
+func (apiV1) credentialsPath() string {
+	return "/api/v1/generateServiceCredentials"
+}
+
+func (apiV1) credentialsRequest(s controllerService) ([]byte, error) {
+	return json.Marshal(controllerServiceCredentialsRequest{
+		AgentName: s.AgentName,
+		Name:      s.Name,
+		Type:      s.Type,
+	})
+}
+
+func (apiV1) parseCredentials(data []byte) (string, ServiceCredential, error) {
+	var creds controllerServiceCredentialResponse
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return "", ServiceCredential{}, fmt.Errorf("cannot decode service credentials JSON: %v", err)
+	}
+	cred, err := parseCredential(creds.CredentialType, creds.Credential)
+	return creds.URL, cred, err
+}
+
+func (apiV1) eventsPath() string {
+	return streamAgentEventsPath
+}
+
+// apiV2 groups agent annotations with the rest of the agent's details,
+// and puts the credential type inside the credential.
+type apiV2 struct{}
+
+type v2AgentsResponse struct {
+	ServerTime int64     `json:"serverTime,omitempty"`
+	Agents     []v2Agent `json:"agents,omitempty"`
+}
+
+type v2Agent struct {
+	Name           string            `json:"name,omitempty"`
+	Session        string            `json:"session,omitempty"`
+	ConnectionType string            `json:"connectionType,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	Hostname       string            `json:"hostname,omitempty"`
+	ConnectedAt    int64             `json:"connectedAt,omitempty"`
+	LastPing       int64             `json:"lastPing,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Endpoints      []agentEndpoint   `json:"endpoints,omitempty"`
+}
+
+type v2CredentialsResponse struct {
+	URL        string          `json:"url,omitempty"`
+	Credential json.RawMessage `json:"credential,omitempty"`
+}
+
+func (apiV2) version() string {
+	return APIVersionV2
+}
+
+func (apiV2) agentsPath() string {
+	return "/api/v2/agents"
+}
+
+func (apiV2) parseAgents(data []byte) (connectedAgentsResponse, error) {
+	var resp v2AgentsResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return connectedAgentsResponse{}, fmt.Errorf("cannot decode agents JSON: %v", err)
+	}
+	ca := connectedAgentsResponse{ServerTime: resp.ServerTime}
+	for _, a := range resp.Agents {
+		agent := connectedAgent{
+			Name:           a.Name,
+			Session:        a.Session,
+			ConnectionType: a.ConnectionType,
+			Endpoints:      a.Endpoints,
+			Version:        a.Version,
+			Hostname:       a.Hostname,
+			ConnectedAt:    a.ConnectedAt,
+			LastPing:       a.LastPing,
+		}
+		agent.AgentInfo.Annotations = a.Annotations
+		ca.ConnectedAgents = append(ca.ConnectedAgents, agent)
+	}
+	return ca, nil
+}
+
+func (apiV2) credentialsPath() string {
+	return "/api/v2/serviceCredentials"
+}
+
+func (apiV2) credentialsRequest(s controllerService) ([]byte, error) {
+	return json.Marshal(controllerServiceCredentialsRequest{
+		AgentName: s.AgentName,
+		Name:      s.Name,
+		Type:      s.Type,
+	})
+}
+
+func (apiV2) parseCredentials(data []byte) (string, ServiceCredential, error) {
+	var resp v2CredentialsResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", ServiceCredential{}, fmt.Errorf("cannot decode service credentials JSON: %v", err)
+	}
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if len(resp.Credential) > 0 {
+		if err := json.Unmarshal(resp.Credential, &typed); err != nil {
+			return "", ServiceCredential{}, fmt.Errorf("cannot decode service credentials JSON: %v", err)
+		}
+	}
+	cred, err := parseCredential(typed.Type, resp.Credential)
+	return resp.URL, cred, err
+}
+
+func (apiV2) eventsPath() string {
+	return "/api/v2/events"
+}
+
+var supportedAPIs = []controllerAPI{apiV2{}, apiV1{}} // newest first
+
+// getAPI returns the API version to use, asking the controller which
+// versions it supports if the config does not say.  The lock is not held
+// while asking, so APIVersion() and ControllerVersion() do not wait for it.
+func (m *ControllerManager) getAPI(ctx context.Context) (controllerAPI, error) {
+	m.apiLock.Lock()
+	api := m.api
+	m.apiLock.Unlock()
+	if api != nil {
+		return api, nil
+	}
+
+	controllerVersion := ""
+	switch m.conf.APIVersion {
+	case APIVersionV1:
+		api = apiV1{}
+	case APIVersionV2:
+		api = apiV2{}
+	default:
+		var err error
+		api, controllerVersion, err = m.probeAPI(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
+	m.api = api
+	m.controllerVersion = controllerVersion
+	return api, nil
+}
+
+// resetAPI causes the next request to probe the controller's API version
+// again, for example after it was downgraded.
+func (m *ControllerManager) resetAPI() {
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
+	if m.conf.APIVersion == APIVersionAuto {
+		m.api = nil
+	}
+}
+
+// probeAPI asks the controller which API versions it supports, and returns
+// the newest one we also support, along with the controller's version.
+// Controllers which only have v1 do not know the question, and answer with
+// 400, 404 or 405, or with something which is not JSON, so those all mean
+// v1.  Any other status is an error, so the next request asks again rather
+// than settling on v1 because of, say, a bad token or a proxy outage.
+func (m *ControllerManager) probeAPI(ctx context.Context) (controllerAPI, string, error) {
+	url, err := url.JoinPath(m.conf.URL, apiVersionPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("joining url: %v", err)
+	}
+	client, err := m.getHTTPClient()
+	if err != nil {
+		return nil, "", withCause(PollErrorTLS, fmt.Errorf("making TLS client: %v", err))
+	}
+	resp, err := m.doRequest(ctx, client, http.MethodGet, url, nil)
+	if err != nil {
+		client.CloseIdleConnections()
+		return nil, "", withCause(errorCause(err, PollErrorRequest), fmt.Errorf("fetching api version: %v", err))
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed:
+		log.Printf("controller api version request returned http status %d, using api %s", resp.StatusCode, APIVersionV1)
+		return apiV1{}, "", nil
+	default:
+		return nil, "", withCause(PollErrorStatus, fmt.Errorf("fetching api version: http status %d", resp.StatusCode))
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", withCause(PollErrorRequest, fmt.Errorf("reading body: %v", err))
+	}
+	var version apiVersionResponse
+	if err := json.Unmarshal(data, &version); err != nil {
+		log.Printf("cannot decode controller api version JSON, using api %s: %v", APIVersionV1, err)
+		return apiV1{}, "", nil
+	}
+	if len(version.APIVersions) == 0 {
+		return apiV1{}, version.Version, nil
+	}
+	for _, api := range supportedAPIs {
+		for _, v := range version.APIVersions {
+			if v == api.version() {
+				return api, version.Version, nil
+			}
+		}
+	}
+	return nil, "", withCause(PollErrorOther, fmt.Errorf("controller supports api versions %v, none of which are known", version.APIVersions))
+}
+
+// APIVersion returns the version of the controller API in use, or ""
+// if it is not yet known.
+func (m *ControllerManager) APIVersion() string {
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
+	if m.api == nil {
+		return ""
+	}
+	return m.api.version()
+}
+
+// ControllerVersion returns the controller's software version, if it
+// reported one when asked for its API versions.
+func (m *ControllerManager) ControllerVersion() string {
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
+	return m.controllerVersion
+}
@@ -0,0 +1,207 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestV2Controller(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiVersionPath, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"version": "2.1.0", "apiVersions": ["v1", "v2", "v9"]}`))
+	})
+	mux.HandleFunc("/api/v2/agents", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"agents": [{"name": "smith", "annotations": {"a": "b"}, "endpoints": [{"name": "one", "type": "whoami", "configured": true}]}]}`))
+	})
+	mux.HandleFunc("/api/v2/serviceCredentials", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"url": "https://one.example.com", "credential": {"type": "bearer", "token": "tok"}}`))
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestControllerManager_apiV2(t *testing.T) {
+	s := newTestV2Controller(t)
+	m, err := NewControllerManager(context.Background(), Config{URL: s.URL, Token: "abc", UpdateFrequencySeconds: 3600}, []string{"whoami"}, WithoutUpdateChan())
+	require.NoError(t, err)
+	t.Cleanup(m.Shutdown)
+
+	_, err = m.Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, APIVersionV2, m.APIVersion())
+	require.Equal(t, "2.1.0", m.ControllerVersion())
+
+	svc, found := m.Service("smith", "one", "whoami")
+	require.True(t, found)
+	require.Equal(t, "https://one.example.com", svc.URL)
+	require.Equal(t, "tok", svc.Token)
+	require.Equal(t, ServiceCredential{Type: CredentialBearer, Token: "tok"}, svc.Credential)
+	require.Equal(t, map[string]string{"a": "b"}, svc.Agent.Annotations)
+}
+
+func TestControllerManager_apiFallsBackToV1(t *testing.T) {
+	c := newTestController(t)
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}, []string{"whoami"}, WithoutUpdateChan())
+	require.NoError(t, err)
+	t.Cleanup(m.Shutdown)
+
+	_, err = m.Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, APIVersionV1, m.APIVersion())
+	require.Equal(t, "", m.ControllerVersion())
+
+	svc, found := m.Service("smith", "whoami", "whoami")
+	require.True(t, found)
+	require.Equal(t, "secret", svc.Token)
+	require.Equal(t, ServiceCredential{Type: CredentialPassword, Password: "secret"}, svc.Credential)
+}
+
+func TestControllerManager_apiVersionConfigured(t *testing.T) {
+	s := newTestV2Controller(t)
+	m, err := NewControllerManager(context.Background(), Config{URL: s.URL, Token: "abc", UpdateFrequencySeconds: 3600, APIVersion: APIVersionV1}, []string{"whoami"}, WithoutUpdateChan())
+	require.NoError(t, err)
+	t.Cleanup(m.Shutdown)
+
+	// the v2 controller has no v1 endpoints, and the version is not probed.
+	_, err = m.Sync(context.Background())
+	require.Error(t, err)
+	require.Equal(t, APIVersionV1, m.APIVersion())
+	require.Equal(t, "", m.ControllerVersion())
+}
+
+func TestControllerManager_apiProbeFallsBackToV1(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"bad request", http.StatusBadRequest, ""},
+		{"not found", http.StatusNotFound, ""},
+		{"method not allowed", http.StatusMethodNotAllowed, ""},
+		{"not json", http.StatusOK, "<html></html>"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t)
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == apiVersionPath {
+					w.WriteHeader(tt.status)
+					_, _ = w.Write([]byte(tt.body))
+					return
+				}
+				c.Config.Handler.ServeHTTP(w, r)
+			}))
+			t.Cleanup(s.Close)
+
+			m, err := NewControllerManager(context.Background(), Config{URL: s.URL, Token: "abc", UpdateFrequencySeconds: 3600}, []string{"whoami"}, WithoutUpdateChan())
+			require.NoError(t, err)
+			t.Cleanup(m.Shutdown)
+			_, err = m.Sync(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, APIVersionV1, m.APIVersion())
+			require.Len(t, m.Services(), 1)
+		})
+	}
+}
+
+func TestControllerManager_apiProbeErrorsAreRetried(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status int
+	}{
+		{"unauthorized", http.StatusUnauthorized},
+		{"forbidden", http.StatusForbidden},
+		{"server error", http.StatusBadGateway},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t)
+			var probes int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == apiVersionPath && atomic.AddInt32(&probes, 1) == 1 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				c.Config.Handler.ServeHTTP(w, r)
+			}))
+			t.Cleanup(s.Close)
+
+			m, err := NewControllerManager(context.Background(), Config{URL: s.URL, Token: "abc", UpdateFrequencySeconds: 3600}, []string{"whoami"}, WithoutUpdateChan())
+			require.NoError(t, err)
+			t.Cleanup(m.Shutdown)
+			_, err = m.Sync(context.Background())
+			require.Error(t, err)
+			require.Equal(t, PollErrorStatus, errorCause(err, PollErrorOther))
+			require.Equal(t, "", m.APIVersion())
+
+			// the next sync asks again.
+			_, err = m.Sync(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, int32(2), atomic.LoadInt32(&probes))
+			require.Len(t, m.Services(), 1)
+		})
+	}
+}
+
+func TestControllerManager_apiProbeDoesNotBlock(t *testing.T) {
+	c := newTestController(t)
+	var once sync.Once
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == apiVersionPath {
+			once.Do(func() { close(probing) })
+			<-release
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		c.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	m, err := NewControllerManager(context.Background(), Config{URL: s.URL, Token: "abc", UpdateFrequencySeconds: 3600}, []string{"whoami"}, WithoutUpdateChan())
+	require.NoError(t, err)
+	t.Cleanup(m.Shutdown)
+	<-probing
+
+	versions := make(chan string)
+	go func() {
+		versions <- m.APIVersion() + m.ControllerVersion()
+	}()
+	select {
+	case v := <-versions:
+		require.Equal(t, "", v)
+	case <-time.After(5 * time.Second):
+		t.Fatal("APIVersion() waited for the probe")
+	}
+	close(release)
+	require.Eventually(t, func() bool { return m.APIVersion() == APIVersionV1 }, 5*time.Second, 10*time.Millisecond)
+}
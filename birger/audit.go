@@ -0,0 +1,73 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// AuditEntry records the changes made by a single sync.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	Diff Diff      `json:"diff"` // tokens are removed
+}
+
+// WithAuditHistory keeps the changes made by the last size syncs which
+// changed anything, for AuditHistory() and AuditHandler().  If not set,
+// no history is kept.
+func WithAuditHistory(size int) Option {
+	return func(m *ControllerManager) {
+		m.auditSize = size
+	}
+}
+
+// recordAudit adds the diff to the audit history, dropping the oldest
+// entry if the history is full.
+func (m *ControllerManager) recordAudit(diff Diff) {
+	if m.auditSize <= 0 || diff.Empty() {
+		return
+	}
+	entry := AuditEntry{Time: m.clock.Now(), Diff: diff.redacted()}
+	m.auditLock.Lock()
+	defer m.auditLock.Unlock()
+	m.audit = append(m.audit, entry)
+	if len(m.audit) > m.auditSize {
+		m.audit = append([]AuditEntry{}, m.audit[len(m.audit)-m.auditSize:]...)
+	}
+}
+
+// AuditHistory returns the changes made by recent syncs, oldest first.
+// It is empty unless WithAuditHistory() was used.
+func (m *ControllerManager) AuditHistory() []AuditEntry {
+	m.auditLock.Lock()
+	defer m.auditLock.Unlock()
+	return append([]AuditEntry{}, m.audit...)
+}
+
+// AuditHandler returns an http.Handler which serves AuditHistory() as
+// JSON, for a debug endpoint.
+func (m *ControllerManager) AuditHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(m.AuditHistory())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write(data)
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestControllerManager_recordAudit(t *testing.T) {
+	m := &ControllerManager{clock: realClock{}, auditSize: 2}
+	m.recordAudit(Diff{})
+	require.Empty(t, m.AuditHistory())
+	for _, name := range []string{"one", "two", "three"} {
+		m.recordAudit(Diff{Added: []Service{{Name: name, Token: "secret"}}})
+	}
+	history := m.AuditHistory()
+	require.Len(t, history, 2)
+	require.Equal(t, "two", history[0].Diff.Added[0].Name)
+	require.Equal(t, "three", history[1].Diff.Added[0].Name)
+	require.Empty(t, history[1].Diff.Added[0].Token)
+}
+
+func TestControllerManager_AuditHandler(t *testing.T) {
+	c := newTestController(t)
+	c.setStatistics(agentStatisticsWith("one"))
+	conf := Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}
+	m, err := NewControllerManager(context.Background(), conf, []string{"whoami"}, WithAuditHistory(10), WithoutUpdateChan())
+	require.NoError(t, err)
+	defer m.Shutdown()
+	require.Eventually(t, func() bool { return len(m.Services()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	c.setStatistics(`{"connectedAgents": [{"name": "smith", "connectedAt": 1, "endpoints": [{"name": "one", "type": "whoami", "configured": true, "annotations": {"env": "prod"}}]}]}`)
+	_, err = m.Sync(context.Background())
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	m.AuditHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/birger/audit", nil))
+	require.Equal(t, "application/json", w.Result().Header.Get("content-type"))
+	require.NotContains(t, w.Body.String(), "secret")
+
+	var history []AuditEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history, 2)
+	require.Equal(t, "one", history[0].Diff.Added[0].Name)
+	require.Equal(t, "https://one.example.com", history[0].Diff.Added[0].URL)
+	require.Equal(t, []AnnotationChange{{Key: "env", After: strp("prod")}}, history[1].Diff.Changed[0].Annotations)
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially increasing delays between min and max,
+// with jitter so many clients failing at once do not retry in lockstep.
+// It is not safe for concurrent use.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// next returns the delay before the next attempt, and doubles the
+// base delay for the attempt after that.  The returned delay is
+// between half and all of the current base delay.
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.min
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	half := b.current / 2
+	return half + time.Duration(rand.Int63n(int64(b.current-half)+1))
+}
+
+// reset is called after a successful attempt.
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+// serviceRetry tracks when a failed credential request for a single
+// service may be tried again.
+type serviceRetry struct {
+	backoff     backoff
+	nextAttempt time.Time
+}
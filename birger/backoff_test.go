@@ -0,0 +1,38 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_backoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 10 * time.Second}
+
+	bases := []time.Duration{1, 2, 4, 8, 10, 10}
+	for _, base := range bases {
+		d := b.next()
+		require.GreaterOrEqual(t, d, base*time.Second/2)
+		require.LessOrEqual(t, d, base*time.Second)
+	}
+
+	b.reset()
+	d := b.next()
+	require.GreaterOrEqual(t, d, time.Second/2)
+	require.LessOrEqual(t, d, time.Second)
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birgertest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/utkarsh-opsmx/go-app-base/birger"
+)
+
+// FakeClock is a birger.Clock which only moves when Advance() is called.
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer which fires once the clock is advanced by d.
+func (c *FakeClock) NewTimer(d time.Duration) birger.Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any timers which expire.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			waiting = append(waiting, t)
+			continue
+		}
+		t.active = false
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+	c.timers = waiting
+}
+
+// Waiters returns how many timers are waiting to fire.  Tests use this
+// to know the manager has scheduled its next sync before calling
+// Advance().
+func (c *FakeClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+// fakeTimer is in its clock's timers list exactly when it is active.
+type fakeTimer struct {
+	clock    *FakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	wasActive := t.active
+	t.active = false
+	t.clock.remove(t)
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	wasActive := t.active
+	t.deadline = t.clock.now.Add(d)
+	if d <= 0 {
+		t.active = false
+		t.clock.remove(t)
+		select {
+		case t.c <- t.clock.now:
+		default:
+		}
+		return wasActive
+	}
+	if !wasActive {
+		t.clock.timers = append(t.clock.timers, t)
+	}
+	t.active = true
+	return wasActive
+}
+
+// remove must be called with the clock locked.
+func (c *FakeClock) remove(t *fakeTimer) {
+	for i, existing := range c.timers {
+		if existing == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birgertest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/utkarsh-opsmx/go-app-base/birger"
+	"github.com/utkarsh-opsmx/go-app-base/birger/birgertest"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := birgertest.NewFakeClock(start)
+
+	timer := clock.NewTimer(time.Minute)
+	require.Equal(t, 1, clock.Waiters())
+	clock.Advance(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+	clock.Advance(time.Second)
+	require.Equal(t, start.Add(time.Minute), <-timer.C())
+	require.Equal(t, 0, clock.Waiters())
+
+	require.False(t, timer.Reset(time.Minute))
+	require.True(t, timer.Stop())
+	require.Equal(t, 0, clock.Waiters())
+}
+
+func TestControllerManager_fakeClock(t *testing.T) {
+	c := birgertest.NewController()
+	defer c.Close()
+	c.AddAgent(birgertest.Agent{
+		Name:      "agent1",
+		Endpoints: []birgertest.Endpoint{{Name: "argo1", Type: "argocd", Configured: true}},
+	})
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := birgertest.NewFakeClock(start)
+	conf := birger.Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 30, MaxCredentialAgeSeconds: 300}
+	m, err := birger.NewControllerManager(context.Background(), conf, []string{"argocd"}, birger.WithClock(clock))
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	update := nextUpdate(t, m)
+	require.Equal(t, birger.OperationAdd, update.Operation)
+	require.Eventually(t, func() bool { return clock.Waiters() == 1 }, 5*time.Second, time.Millisecond)
+	require.Equal(t, start.Add(30*time.Second), m.NextAttempt())
+
+	require.NoError(t, c.AddEndpoint("agent1", birgertest.Endpoint{Name: "argo2", Type: "argocd", Configured: true}))
+	clock.Advance(30 * time.Second)
+	update = nextUpdate(t, m)
+	require.Equal(t, birger.OperationAdd, update.Operation)
+	require.Equal(t, "argo2", update.Name)
+	require.Len(t, c.CredentialRequests(), 2)
+
+	// both sets of credentials expire at once.
+	require.Eventually(t, func() bool { return clock.Waiters() == 1 }, 5*time.Second, time.Millisecond)
+	clock.Advance(300 * time.Second)
+	for i := 0; i < 2; i++ {
+		update = nextUpdate(t, m)
+		require.Equal(t, birger.OperationUpdate, update.Operation)
+	}
+	require.Len(t, c.CredentialRequests(), 4)
+}
+
+func TestControllerManager_Sync(t *testing.T) {
+	c := birgertest.NewController()
+	defer c.Close()
+	c.AddAgent(birgertest.Agent{
+		Name:      "agent1",
+		Endpoints: []birgertest.Endpoint{{Name: "argo1", Type: "argocd", Configured: true}},
+	})
+
+	clock := birgertest.NewFakeClock(time.Now())
+	conf := birger.Config{URL: c.URL, Token: "abc"}
+	m, err := birger.NewControllerManager(context.Background(), conf, []string{"argocd"}, birger.WithClock(clock))
+	require.NoError(t, err)
+	defer m.Shutdown()
+	nextUpdate(t, m)
+
+	ctx := context.Background()
+	diff, err := m.Sync(ctx)
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+
+	require.NoError(t, c.AddEndpoint("agent1", birgertest.Endpoint{Name: "argo2", Type: "argocd", Configured: true}))
+	require.NoError(t, c.SetEndpointAnnotations("agent1", "argo1", "argocd", map[string]string{"env": "prod"}))
+	diff, err = m.Sync(ctx)
+	require.NoError(t, err)
+	require.Len(t, diff.Added, 1)
+	require.Equal(t, "argo2", diff.Added[0].Name)
+	require.Equal(t, birgertest.URLFor("agent1", "argo2", "argocd"), diff.Added[0].URL)
+	require.Len(t, diff.Changed, 1)
+	require.Equal(t, map[string]string{"env": "prod"}, diff.Changed[0].Service.Annotations)
+	prod := "prod"
+	require.Equal(t, []birger.AnnotationChange{{Key: "env", After: &prod}}, diff.Changed[0].Annotations)
+	require.Empty(t, diff.Removed)
+	nextUpdate(t, m)
+	nextUpdate(t, m)
+
+	require.NoError(t, c.RemoveEndpoint("agent1", "argo1", "argocd"))
+	diff, err = m.Sync(ctx)
+	require.NoError(t, err)
+	require.Len(t, diff.Removed, 1)
+	require.Equal(t, "argo1", diff.Removed[0].Name)
+	nextUpdate(t, m)
+
+	c.InjectError(birgertest.AgentStatisticsPath, http.StatusBadGateway)
+	_, err = m.Sync(ctx)
+	require.Error(t, err)
+	require.Error(t, m.Check())
+
+	m.Shutdown()
+	_, err = m.Sync(ctx)
+	require.Error(t, err)
+}
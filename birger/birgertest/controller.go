@@ -0,0 +1,488 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package birgertest provides a fake controller for testing code which
+// uses birger.ControllerManager without a real controller.
+package birgertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/utkarsh-opsmx/go-app-base/sse"
+)
+
+// Paths served by the fake controller.
+const (
+	AgentStatisticsPath    = "/api/v1/getAgentStatistics"
+	ServiceCredentialsPath = "/api/v1/generateServiceCredentials"
+	StreamAgentEventsPath  = "/api/v1/streamAgentEvents"
+)
+
+// Agent is an agent connected to the fake controller.
+type Agent struct {
+	Name           string
+	Session        string
+	Hostname       string
+	Version        string
+	ConnectionType string
+	ConnectedAt    time.Time
+	LastPing       time.Time
+	Annotations    map[string]string
+	Endpoints      []Endpoint
+}
+
+// Endpoint is a service an Agent provides.
+type Endpoint struct {
+	Name        string
+	Type        string
+	Configured  bool
+	Annotations map[string]string
+}
+
+// CredentialRequest records a request for service credentials.
+type CredentialRequest struct {
+	AgentName string
+	Name      string
+	Type      string
+	Time      time.Time
+}
+
+// Controller is an in-process fake of the controller API used by
+// birger.ControllerManager.  Create one with NewController(), point the
+// manager's Config.URL at its URL, and call Close() when done.
+//
+// All methods are safe to call while the manager is using the controller.
+type Controller struct {
+	*httptest.Server
+
+	lock               sync.Mutex
+	agents             map[string]*Agent
+	requiredToken      string
+	latency            time.Duration
+	errors             map[string]int
+	credentialErrors   map[string]int
+	credentialRequests []CredentialRequest
+	credentialCount    int
+	serverTime         time.Time
+	watchers           map[chan string]struct{}
+}
+
+// NewController starts a fake controller with no agents.
+func NewController() *Controller {
+	c := &Controller{
+		agents:           map[string]*Agent{},
+		errors:           map[string]int{},
+		credentialErrors: map[string]int{},
+		watchers:         map[chan string]struct{}{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(AgentStatisticsPath, c.handleAgentStatistics)
+	mux.HandleFunc(ServiceCredentialsPath, c.handleServiceCredentials)
+	mux.HandleFunc(StreamAgentEventsPath, c.handleStreamAgentEvents)
+	c.Server = httptest.NewServer(c.middleware(mux))
+	return c
+}
+
+// Close disconnects any event streams and shuts down the server.
+func (c *Controller) Close() {
+	c.lock.Lock()
+	for w := range c.watchers {
+		close(w)
+	}
+	c.watchers = map[chan string]struct{}{}
+	c.lock.Unlock()
+	c.Server.Close()
+}
+
+func serviceKey(agentName string, name string, serviceType string) string {
+	return agentName + ":" + name + ":" + serviceType
+}
+
+// AddAgent connects an agent, replacing any with the same name.
+// ConnectedAt and LastPing default to now.
+func (c *Controller) AddAgent(a Agent) {
+	now := time.Now()
+	if a.ConnectedAt.IsZero() {
+		a.ConnectedAt = now
+	}
+	if a.LastPing.IsZero() {
+		a.LastPing = now
+	}
+	a.Endpoints = append([]Endpoint(nil), a.Endpoints...)
+	c.lock.Lock()
+	c.agents[a.Name] = &a
+	c.lock.Unlock()
+	c.notify("agentConnected")
+}
+
+// RemoveAgent disconnects an agent.
+func (c *Controller) RemoveAgent(name string) {
+	c.lock.Lock()
+	delete(c.agents, name)
+	c.lock.Unlock()
+	c.notify("agentDisconnected")
+}
+
+// AddEndpoint adds an endpoint to a connected agent, replacing any with
+// the same name and type.
+func (c *Controller) AddEndpoint(agentName string, ep Endpoint) error {
+	err := c.withAgent(agentName, func(a *Agent) {
+		for i, existing := range a.Endpoints {
+			if existing.Name == ep.Name && existing.Type == ep.Type {
+				a.Endpoints[i] = ep
+				return
+			}
+		}
+		a.Endpoints = append(a.Endpoints, ep)
+	})
+	if err == nil {
+		c.notify("endpointsChanged")
+	}
+	return err
+}
+
+// RemoveEndpoint removes an endpoint from a connected agent.
+func (c *Controller) RemoveEndpoint(agentName string, name string, serviceType string) error {
+	err := c.withAgent(agentName, func(a *Agent) {
+		for i, existing := range a.Endpoints {
+			if existing.Name == name && existing.Type == serviceType {
+				a.Endpoints = append(a.Endpoints[:i], a.Endpoints[i+1:]...)
+				return
+			}
+		}
+	})
+	if err == nil {
+		c.notify("endpointsChanged")
+	}
+	return err
+}
+
+// SetEndpointAnnotations replaces the annotations of an endpoint.
+func (c *Controller) SetEndpointAnnotations(agentName string, name string, serviceType string, annotations map[string]string) error {
+	found := false
+	err := c.withAgent(agentName, func(a *Agent) {
+		for i, existing := range a.Endpoints {
+			if existing.Name == name && existing.Type == serviceType {
+				a.Endpoints[i].Annotations = annotations
+				found = true
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("agent %s has no endpoint %s of type %s", agentName, name, serviceType)
+	}
+	c.notify("endpointsChanged")
+	return nil
+}
+
+// SetAgentAnnotations replaces the annotations of an agent.
+func (c *Controller) SetAgentAnnotations(agentName string, annotations map[string]string) error {
+	err := c.withAgent(agentName, func(a *Agent) {
+		a.Annotations = annotations
+	})
+	if err == nil {
+		c.notify("agentConnected")
+	}
+	return err
+}
+
+// SetLastPing sets when the agent last pinged the controller.
+func (c *Controller) SetLastPing(agentName string, when time.Time) error {
+	return c.withAgent(agentName, func(a *Agent) {
+		a.LastPing = when
+	})
+}
+
+// SetServerTime fixes the serverTime reported by the controller.  A zero
+// time, the default, reports the current time.
+func (c *Controller) SetServerTime(when time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.serverTime = when
+}
+
+func (c *Controller) withAgent(agentName string, f func(*Agent)) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	a, found := c.agents[agentName]
+	if !found {
+		return fmt.Errorf("agent %s is not connected", agentName)
+	}
+	f(a)
+	return nil
+}
+
+// RequireToken makes every request without this bearer token fail with
+// a 401.  An empty token accepts any request.
+func (c *Controller) RequireToken(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requiredToken = token
+}
+
+// SetLatency delays every response by d.
+func (c *Controller) SetLatency(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.latency = d
+}
+
+// InjectError makes every request to path fail with the HTTP status code
+// given, until ClearErrors() is called.
+func (c *Controller) InjectError(path string, statusCode int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.errors[path] = statusCode
+}
+
+// InjectCredentialError makes credential requests for one service fail
+// with the HTTP status code given, until ClearErrors() is called.
+func (c *Controller) InjectCredentialError(agentName string, name string, serviceType string, statusCode int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.credentialErrors[serviceKey(agentName, name, serviceType)] = statusCode
+}
+
+// ClearErrors removes all injected errors.
+func (c *Controller) ClearErrors() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.errors = map[string]int{}
+	c.credentialErrors = map[string]int{}
+}
+
+// CredentialRequests returns every credential request received, in order,
+// including those which failed.
+func (c *Controller) CredentialRequests() []CredentialRequest {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]CredentialRequest(nil), c.credentialRequests...)
+}
+
+// URLFor returns the URL the fake controller issues for a service.
+func URLFor(agentName string, name string, serviceType string) string {
+	return fmt.Sprintf("https://%s.%s.%s.example.com", name, serviceType, agentName)
+}
+
+func (c *Controller) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.lock.Lock()
+		latency := c.latency
+		required := c.requiredToken
+		status := c.errors[r.URL.Path]
+		c.lock.Unlock()
+
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if required != "" && r.Header.Get("authorization") != "Bearer "+required {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type connectedAgentsResponse struct {
+	ServerTime      int64            `json:"serverTime"`
+	ConnectedAgents []connectedAgent `json:"connectedAgents"`
+}
+
+type connectedAgent struct {
+	Name           string          `json:"name"`
+	Session        string          `json:"session,omitempty"`
+	ConnectionType string          `json:"connectionType,omitempty"`
+	Endpoints      []agentEndpoint `json:"endpoints"`
+	Version        string          `json:"version,omitempty"`
+	Hostname       string          `json:"hostname,omitempty"`
+	ConnectedAt    int64           `json:"connectedAt"`
+	LastPing       int64           `json:"lastPing"`
+	AgentInfo      struct {
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"agentInfo"`
+}
+
+type agentEndpoint struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Configured  bool              `json:"configured"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (c *Controller) handleAgentStatistics(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	serverTime := c.serverTime
+	if serverTime.IsZero() {
+		serverTime = time.Now()
+	}
+	resp := connectedAgentsResponse{
+		ServerTime:      serverTime.UnixMilli(),
+		ConnectedAgents: []connectedAgent{},
+	}
+	for _, a := range c.agents {
+		ca := connectedAgent{
+			Name:           a.Name,
+			Session:        a.Session,
+			ConnectionType: a.ConnectionType,
+			Version:        a.Version,
+			Hostname:       a.Hostname,
+			ConnectedAt:    a.ConnectedAt.UnixMilli(),
+			LastPing:       a.LastPing.UnixMilli(),
+			Endpoints:      []agentEndpoint{},
+		}
+		ca.AgentInfo.Annotations = a.Annotations
+		for _, ep := range a.Endpoints {
+			ca.Endpoints = append(ca.Endpoints, agentEndpoint(ep))
+		}
+		resp.ConnectedAgents = append(resp.ConnectedAgents, ca)
+	}
+	c.lock.Unlock()
+
+	sort.Slice(resp.ConnectedAgents, func(i, j int) bool {
+		return resp.ConnectedAgents[i].Name < resp.ConnectedAgents[j].Name
+	})
+	writeJSON(w, resp)
+}
+
+type credentialsRequest struct {
+	AgentName string `json:"agentName"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+}
+
+type credentialsResponse struct {
+	AgentName      string `json:"agentName"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	CredentialType string `json:"credentialType"`
+	Credential     struct {
+		Password string `json:"password"`
+	} `json:"credential"`
+	URL string `json:"url"`
+}
+
+func (c *Controller) handleServiceCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.lock.Lock()
+	c.credentialRequests = append(c.credentialRequests, CredentialRequest{
+		AgentName: req.AgentName,
+		Name:      req.Name,
+		Type:      req.Type,
+		Time:      time.Now(),
+	})
+	status := c.credentialErrors[serviceKey(req.AgentName, req.Name, req.Type)]
+	c.credentialCount++
+	count := c.credentialCount
+	c.lock.Unlock()
+
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	resp := credentialsResponse{
+		AgentName:      req.AgentName,
+		Name:           req.Name,
+		Type:           req.Type,
+		CredentialType: "password",
+		URL:            URLFor(req.AgentName, req.Name, req.Type),
+	}
+	resp.Credential.Password = fmt.Sprintf("token-%d", count)
+	writeJSON(w, resp)
+}
+
+func (c *Controller) handleStreamAgentEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	events := make(chan string, 10)
+	c.lock.Lock()
+	c.watchers[events] = struct{}{}
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.watchers, events)
+		c.lock.Unlock()
+	}()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	stream := sse.NewSSE(nil)
+	_ = stream.KeepAlive(w)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case name, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := stream.Write(w, sse.Event{"event": name}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// notify sends an event to every connected event stream.  Slow readers
+// miss events, which is fine as any event causes a full sync.
+func (c *Controller) notify(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for w := range c.watchers {
+		select {
+		case w <- name:
+		default:
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birgertest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/utkarsh-opsmx/go-app-base/birger"
+	"github.com/utkarsh-opsmx/go-app-base/birger/birgertest"
+)
+
+func nextUpdate(t *testing.T, m *birger.ControllerManager) birger.ServiceUpdate {
+	t.Helper()
+	select {
+	case update := <-m.UpdateChan:
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+	return birger.ServiceUpdate{}
+}
+
+func TestController(t *testing.T) {
+	c := birgertest.NewController()
+	defer c.Close()
+	c.RequireToken("abc")
+	c.AddAgent(birgertest.Agent{
+		Name:      "agent1",
+		Endpoints: []birgertest.Endpoint{{Name: "argo1", Type: "argocd", Configured: true}},
+	})
+
+	conf := birger.Config{URL: c.URL, Token: "abc", Watch: true, UpdateFrequencySeconds: 3600}
+	m, err := birger.NewControllerManager(context.Background(), conf, []string{"argocd"})
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	update := nextUpdate(t, m)
+	require.Equal(t, birger.OperationAdd, update.Operation)
+	require.Equal(t, "argo1", update.Name)
+	require.Equal(t, birgertest.URLFor("agent1", "argo1", "argocd"), update.URL)
+
+	require.NoError(t, c.AddEndpoint("agent1", birgertest.Endpoint{Name: "argo2", Type: "argocd", Configured: true}))
+	update = nextUpdate(t, m)
+	require.Equal(t, birger.OperationAdd, update.Operation)
+	require.Equal(t, "argo2", update.Name)
+
+	require.NoError(t, c.SetEndpointAnnotations("agent1", "argo2", "argocd", map[string]string{"env": "prod"}))
+	update = nextUpdate(t, m)
+	require.Equal(t, birger.OperationUpdate, update.Operation)
+	require.Equal(t, map[string]string{"env": "prod"}, update.Annotations)
+
+	c.RemoveAgent("agent1")
+	removed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		update = nextUpdate(t, m)
+		require.Equal(t, birger.OperationDelete, update.Operation)
+		removed[update.Name] = true
+	}
+	require.Equal(t, map[string]bool{"argo1": true, "argo2": true}, removed)
+
+	requests := c.CredentialRequests()
+	require.Len(t, requests, 2)
+	require.Equal(t, "agent1", requests[0].AgentName)
+	require.Equal(t, "argo1", requests[0].Name)
+}
+
+func TestController_errors(t *testing.T) {
+	c := birgertest.NewController()
+	defer c.Close()
+	c.AddAgent(birgertest.Agent{
+		Name:      "agent1",
+		Endpoints: []birgertest.Endpoint{{Name: "argo1", Type: "argocd", Configured: true}},
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	c.InjectError(birgertest.AgentStatisticsPath, http.StatusServiceUnavailable)
+	resp, err := client.Get(c.URL + birgertest.AgentStatisticsPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	c.ClearErrors()
+	c.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	resp, err = client.Get(c.URL + birgertest.AgentStatisticsPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	c.RequireToken("abc")
+	resp, err = client.Get(c.URL + birgertest.AgentStatisticsPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	require.Error(t, c.AddEndpoint("missing", birgertest.Endpoint{Name: "x", Type: "y"}))
+	require.Error(t, c.SetEndpointAnnotations("agent1", "missing", "argocd", nil))
+}
+
+func TestController_credentialError(t *testing.T) {
+	c := birgertest.NewController()
+	defer c.Close()
+	c.AddAgent(birgertest.Agent{
+		Name: "agent1",
+		Endpoints: []birgertest.Endpoint{
+			{Name: "argo1", Type: "argocd", Configured: true},
+			{Name: "argo2", Type: "argocd", Configured: true},
+		},
+	})
+	c.InjectCredentialError("agent1", "argo1", "argocd", http.StatusInternalServerError)
+
+	conf := birger.Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}
+	m, err := birger.NewControllerManager(context.Background(), conf, []string{"argocd"})
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	update := nextUpdate(t, m)
+	require.Equal(t, "argo2", update.Name)
+	require.Eventually(t, func() bool {
+		return len(c.CredentialRequests()) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	_, found := m.Service("agent1", "argo1", "argocd")
+	require.False(t, found)
+}
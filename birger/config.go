@@ -15,29 +15,206 @@
 package birger
 
 import (
-	"log"
+	"crypto/tls"
+	"fmt"
+	"net/url"
 	"os"
+	"strings"
 )
 
 type Config struct {
 	URL                    string `json:"url,omitempty" yaml:"url,omitempty"`
 	Token                  string `json:"token,omitempty" yaml:"token,omitempty"`
 	UpdateFrequencySeconds int    `json:"updateFrequencySeconds,omitempty" yaml:"updateFrequencySeconds,omitempty"`
+	// TokenFile and TokenCommand are alternatives to Token.  TokenFile is
+	// read again whenever it changes, and TokenCommand (a program and its
+	// arguments) is run again after TokenCommandCacheSeconds, or when the
+	// controller rejects the token.  Only one of Token, TokenFile, or
+	// TokenCommand may be set.
+	TokenFile                string   `json:"tokenFile,omitempty" yaml:"tokenFile,omitempty"`
+	TokenCommand             []string `json:"tokenCommand,omitempty" yaml:"tokenCommand,omitempty"`
+	TokenCommandCacheSeconds int      `json:"tokenCommandCacheSeconds,omitempty" yaml:"tokenCommandCacheSeconds,omitempty"`
+	// MaxCredentialAgeSeconds, if set, causes service credentials older
+	// than this to be fetched again from the controller.  If 0, credentials
+	// are kept until invalidated or the service goes away.
+	MaxCredentialAgeSeconds int `json:"maxCredentialAgeSeconds,omitempty" yaml:"maxCredentialAgeSeconds,omitempty"`
+	// MinBackoffSeconds and MaxBackoffSeconds bound the exponential backoff
+	// used when polling the controller or fetching credentials fails.
+	MinBackoffSeconds int `json:"minBackoffSeconds,omitempty" yaml:"minBackoffSeconds,omitempty"`
+	MaxBackoffSeconds int `json:"maxBackoffSeconds,omitempty" yaml:"maxBackoffSeconds,omitempty"`
+
+	// Watch enables consuming the controller's event stream, so changes are
+	// seen within seconds.  While the stream is connected, polling only
+	// happens every WatchResyncSeconds.  If the stream drops, polling at
+	// UpdateFrequencySeconds resumes until it reconnects.
+	Watch              bool `json:"watch,omitempty" yaml:"watch,omitempty"`
+	WatchResyncSeconds int  `json:"watchResyncSeconds,omitempty" yaml:"watchResyncSeconds,omitempty"`
+
+	// StaleAgentSeconds, if set, marks an agent stale when the controller has
+	// not heard a ping from it for this long.  StaleAction is either "stale"
+	// (the default), which sends an OperationStale update and keeps the
+	// services, or "delete", which removes them until the agent pings again.
+	StaleAgentSeconds int    `json:"staleAgentSeconds,omitempty" yaml:"staleAgentSeconds,omitempty"`
+	StaleAction       string `json:"staleAction,omitempty" yaml:"staleAction,omitempty"`
+
+	// APIVersion selects the version of the controller API to use: "v1",
+	// "v2", or "auto" (the default), which asks the controller which
+	// versions it supports and uses the newest one both understand.
+	APIVersion string `json:"apiVersion,omitempty" yaml:"apiVersion,omitempty"`
+
+	// CACertFile, ClientCertFile, and ClientKeyFile are PEM files used when
+	// talking to the controller.  The CA certificates are trusted in addition
+	// to the system roots, or to the RootCAs of TLSConfig if it has them.  Changes to the files on disk are picked up
+	// without a restart.
+	CACertFile     string `json:"caCertFile,omitempty" yaml:"caCertFile,omitempty"`
+	ClientCertFile string `json:"clientCertFile,omitempty" yaml:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty" yaml:"clientKeyFile,omitempty"`
+	// ServerName overrides the name used to verify the controller's certificate.
+	ServerName string `json:"serverName,omitempty" yaml:"serverName,omitempty"`
+	// TLSConfig, if set, is used as the base TLS configuration, with the
+	// settings above applied on top of it.  If not set, the app-wide one
+	// from httputil.SetTLSConfig() is the base.
+	TLSConfig *tls.Config `json:"-" yaml:"-"`
 }
 
 var defaultConfig = Config{
 	UpdateFrequencySeconds: 30,
+	MinBackoffSeconds:      1,
+	MaxBackoffSeconds:      300,
+	WatchResyncSeconds:     300,
+	StaleAction:            StaleActionStale,
+	APIVersion:             APIVersionAuto,
 }
 
+const maxUpdateFrequencySeconds = 24 * 60 * 60
+
+// Values for Config.StaleAction.
+const (
+	StaleActionStale  = "stale"
+	StaleActionDelete = "delete"
+)
+
+// Values for Config.APIVersion.
+const (
+	APIVersionAuto = "auto"
+	APIVersionV1   = "v1"
+	APIVersionV2   = "v2"
+)
+
 func (cc *Config) applyDefaults() {
-	if cc.Token == "" {
-		t, found := os.LookupEnv("CONTROLLER_TOKEN")
-		if !found {
-			log.Fatal("no token in config, nor CONTROLLER_TOKEN envar")
-		}
-		cc.Token = t
+	if cc.Token == "" && cc.TokenFile == "" && len(cc.TokenCommand) == 0 {
+		cc.Token = os.Getenv("CONTROLLER_TOKEN")
 	}
 	if cc.UpdateFrequencySeconds == 0 {
 		cc.UpdateFrequencySeconds = defaultConfig.UpdateFrequencySeconds
 	}
+	if cc.MinBackoffSeconds == 0 {
+		cc.MinBackoffSeconds = defaultConfig.MinBackoffSeconds
+	}
+	if cc.MaxBackoffSeconds == 0 {
+		cc.MaxBackoffSeconds = defaultConfig.MaxBackoffSeconds
+	}
+	if cc.MaxBackoffSeconds < cc.MinBackoffSeconds {
+		cc.MaxBackoffSeconds = cc.MinBackoffSeconds
+	}
+	if cc.WatchResyncSeconds == 0 {
+		cc.WatchResyncSeconds = defaultConfig.WatchResyncSeconds
+	}
+	if cc.StaleAction == "" {
+		cc.StaleAction = defaultConfig.StaleAction
+	}
+	if cc.APIVersion == "" {
+		cc.APIVersion = defaultConfig.APIVersion
+	}
+}
+
+// ConfigError is returned by Validate() and lists every problem
+// found in a Config.
+type ConfigError struct {
+	Errors []error
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "invalid controller config: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap allows errors.Is() and errors.As() to find the individual errors.
+func (e *ConfigError) Unwrap() []error {
+	return e.Errors
+}
+
+// Validate checks the config, after applying defaults, and returns
+// a *ConfigError listing all problems found, or nil if there are none.
+// The token may come from the CONTROLLER_TOKEN envar.
+func (cc Config) Validate() error {
+	return cc.validate(false)
+}
+
+// validate is Validate(), but does not require a token to be configured
+// if one will come from a TokenSource given to the manager instead.
+func (cc Config) validate(haveTokenSource bool) error {
+	cc.applyDefaults()
+	errs := []error{}
+
+	if cc.URL == "" {
+		errs = append(errs, fmt.Errorf("url is required"))
+	} else if u, err := url.Parse(cc.URL); err != nil {
+		errs = append(errs, fmt.Errorf("url: %v", err))
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("url: scheme must be http or https, not %q", u.Scheme))
+	} else if u.Host == "" {
+		errs = append(errs, fmt.Errorf("url: host is required"))
+	}
+
+	tokensSet := 0
+	for _, set := range []bool{cc.Token != "", cc.TokenFile != "", len(cc.TokenCommand) > 0} {
+		if set {
+			tokensSet++
+		}
+	}
+	if tokensSet == 0 && !haveTokenSource {
+		errs = append(errs, fmt.Errorf("no token in config, nor CONTROLLER_TOKEN envar"))
+	}
+	if tokensSet > 1 {
+		errs = append(errs, fmt.Errorf("only one of token, tokenFile, or tokenCommand may be set"))
+	}
+	if cc.TokenCommandCacheSeconds < 0 {
+		errs = append(errs, fmt.Errorf("tokenCommandCacheSeconds must not be negative"))
+	}
+
+	if cc.UpdateFrequencySeconds < 1 || cc.UpdateFrequencySeconds > maxUpdateFrequencySeconds {
+		errs = append(errs, fmt.Errorf("updateFrequencySeconds must be between 1 and %d", maxUpdateFrequencySeconds))
+	}
+	if cc.WatchResyncSeconds < 0 {
+		errs = append(errs, fmt.Errorf("watchResyncSeconds must not be negative"))
+	}
+	if cc.StaleAgentSeconds < 0 {
+		errs = append(errs, fmt.Errorf("staleAgentSeconds must not be negative"))
+	}
+	if cc.StaleAction != StaleActionStale && cc.StaleAction != StaleActionDelete {
+		errs = append(errs, fmt.Errorf("staleAction must be %q or %q, not %q", StaleActionStale, StaleActionDelete, cc.StaleAction))
+	}
+	switch cc.APIVersion {
+	case APIVersionAuto, APIVersionV1, APIVersionV2:
+	default:
+		errs = append(errs, fmt.Errorf("apiVersion must be %q, %q, or %q, not %q", APIVersionAuto, APIVersionV1, APIVersionV2, cc.APIVersion))
+	}
+	if cc.MinBackoffSeconds < 0 {
+		errs = append(errs, fmt.Errorf("minBackoffSeconds must not be negative"))
+	}
+	if cc.MaxCredentialAgeSeconds < 0 {
+		errs = append(errs, fmt.Errorf("maxCredentialAgeSeconds must not be negative"))
+	}
+	if (cc.ClientCertFile == "") != (cc.ClientKeyFile == "") {
+		errs = append(errs, fmt.Errorf("both clientCertFile and clientKeyFile must be set"))
+	}
+
+	if len(errs) > 0 {
+		return &ConfigError{Errors: errs}
+	}
+	return nil
 }
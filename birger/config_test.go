@@ -15,6 +15,7 @@
 package birger
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -33,6 +34,11 @@ func TestConfig_applyDefaults(t *testing.T) {
 				URL:                    "abc",
 				Token:                  "abc",
 				UpdateFrequencySeconds: defaultConfig.UpdateFrequencySeconds,
+				MinBackoffSeconds:      defaultConfig.MinBackoffSeconds,
+				MaxBackoffSeconds:      defaultConfig.MaxBackoffSeconds,
+				WatchResyncSeconds:     defaultConfig.WatchResyncSeconds,
+				StaleAction:            defaultConfig.StaleAction,
+				APIVersion:             defaultConfig.APIVersion,
 			},
 		}, {
 			"token isn't overwritten",
@@ -41,6 +47,11 @@ func TestConfig_applyDefaults(t *testing.T) {
 				URL:                    defaultConfig.URL,
 				Token:                  "xyz",
 				UpdateFrequencySeconds: defaultConfig.UpdateFrequencySeconds,
+				MinBackoffSeconds:      defaultConfig.MinBackoffSeconds,
+				MaxBackoffSeconds:      defaultConfig.MaxBackoffSeconds,
+				WatchResyncSeconds:     defaultConfig.WatchResyncSeconds,
+				StaleAction:            defaultConfig.StaleAction,
+				APIVersion:             defaultConfig.APIVersion,
 			},
 		}, {
 			"UpdateFrequencySeconds provided isn't overwritten",
@@ -49,6 +60,23 @@ func TestConfig_applyDefaults(t *testing.T) {
 				URL:                    defaultConfig.URL,
 				Token:                  "abc",
 				UpdateFrequencySeconds: 1234,
+				MinBackoffSeconds:      defaultConfig.MinBackoffSeconds,
+				MaxBackoffSeconds:      defaultConfig.MaxBackoffSeconds,
+				WatchResyncSeconds:     defaultConfig.WatchResyncSeconds,
+				StaleAction:            defaultConfig.StaleAction,
+				APIVersion:             defaultConfig.APIVersion,
+			},
+		}, {
+			"MaxBackoffSeconds is at least MinBackoffSeconds",
+			Config{Token: "abc", MinBackoffSeconds: 10, MaxBackoffSeconds: 5},
+			Config{
+				Token:                  "abc",
+				UpdateFrequencySeconds: defaultConfig.UpdateFrequencySeconds,
+				MinBackoffSeconds:      10,
+				MaxBackoffSeconds:      10,
+				WatchResyncSeconds:     defaultConfig.WatchResyncSeconds,
+				StaleAction:            defaultConfig.StaleAction,
+				APIVersion:             defaultConfig.APIVersion,
 			},
 		},
 	}
@@ -59,3 +87,60 @@ func TestConfig_applyDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_Validate(t *testing.T) {
+	t.Setenv("CONTROLLER_TOKEN", "")
+
+	tests := []struct {
+		name     string
+		provided Config
+		wantErrs int
+	}{
+		{"valid", Config{URL: "https://controller.example.com", Token: "abc"}, 0},
+		{"missing everything", Config{}, 2},
+		{"bad scheme", Config{URL: "ftp://controller.example.com", Token: "abc"}, 1},
+		{"no host", Config{URL: "https://", Token: "abc"}, 1},
+		{"unparsable url", Config{URL: "https://[::1", Token: "abc"}, 1},
+		{"frequency too large", Config{URL: "https://c", Token: "abc", UpdateFrequencySeconds: maxUpdateFrequencySeconds + 1}, 1},
+		{"negative values", Config{URL: "https://c", Token: "abc", UpdateFrequencySeconds: -1, MinBackoffSeconds: -1, MaxCredentialAgeSeconds: -1}, 3},
+		{"bad stale action", Config{URL: "https://c", Token: "abc", StaleAction: "ignore"}, 1},
+		{"bad api version", Config{URL: "https://c", Token: "abc", APIVersion: "v3"}, 1},
+		{"cert without key", Config{URL: "https://c", Token: "abc", ClientCertFile: "cert.pem"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.provided.Validate()
+			if tt.wantErrs == 0 {
+				require.NoError(t, err)
+				return
+			}
+			var configErr *ConfigError
+			require.ErrorAs(t, err, &configErr)
+			require.Len(t, configErr.Errors, tt.wantErrs)
+		})
+	}
+
+	t.Run("token from envar", func(t *testing.T) {
+		t.Setenv("CONTROLLER_TOKEN", "xyz")
+		require.NoError(t, Config{URL: "https://c"}.Validate())
+	})
+}
+
+func TestNewControllerManager_invalidConfig(t *testing.T) {
+	t.Setenv("CONTROLLER_TOKEN", "")
+	m, err := NewControllerManager(context.Background(), Config{URL: "https://c"}, []string{"whoami"})
+	require.Error(t, err)
+	require.Nil(t, m)
+}
+
+func TestConfig_tokenSource(t *testing.T) {
+	t.Setenv("CONTROLLER_TOKEN", "")
+
+	require.IsType(t, staticTokenSource(""), (&Config{Token: "abc"}).tokenSource())
+	require.IsType(t, &FileTokenSource{}, (&Config{TokenFile: "/token"}).tokenSource())
+	require.IsType(t, &ExecTokenSource{}, (&Config{TokenCommand: []string{"get-token"}}).tokenSource())
+
+	err := Config{URL: "https://c", Token: "abc", TokenFile: "/token"}.Validate()
+	require.Error(t, err)
+	require.NoError(t, Config{URL: "https://c", TokenFile: "/token"}.Validate())
+}
@@ -16,123 +16,496 @@ package birger
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto/cipher"
 	"encoding/json"
 	"fmt"
-	"github.com/utkarsh-opsmx/go-app-base/util"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const tracerName = "github.com/utkarsh-opsmx/go-app-base/birger"
+
 // ControllerManager checks the services available on the controller,
 // and fetches new tokens for newly discovered services.  It will
 // update the ArgoManager with new endpoints, and remove old ones.
+//
+// Updates are delivered to each Subscription, and to UpdateChan unless
+// WithoutUpdateChan() was used.
 type ControllerManager struct {
-	UpdateChan        chan ServiceUpdate
+	UpdateChan        <-chan ServiceUpdate
 	conf              Config
-	serviceTypes      []string
-	shutdownWorker    chan bool
+	selectorLock      sync.Mutex
+	selector          *compiledSelector
+	initialSelector   *ServiceSelector
+	ctx               context.Context
+	cancel            context.CancelFunc
+	shutdownOnce      sync.Once
 	shutdownCount     sync.WaitGroup
 	updateRate        time.Duration
+	watchResyncRate   time.Duration
+	statusLock        sync.Mutex
 	healthcheckStatus error
+	nextAttempt       time.Time
+	streaming         bool
+	// syncLock is held for the duration of each sync, so the worker and
+	// Sync() do not run at the same time.
+	syncLock sync.Mutex
+	// services is only changed during a sync, while holding servicesLock,
+	// so a sync may read it without the lock.
+	servicesLock      sync.RWMutex
 	services          map[string]controllerService
+	servicesVersion   uint64
+	httpClient        *http.Client
+	tlsClientLock     sync.Mutex
 	tlsClient         *http.Client
+	tlsFiles          map[string]time.Time
+	credentialStore   CredentialStore
+	tokenSource       TokenSource
+	maxCredentialAge  time.Duration
+	syncNow           chan struct{}
+	invalidLock       sync.Mutex
+	invalidated       map[string]bool
+	pollBackoff       backoff
+	serviceRetries    map[string]*serviceRetry
+	withoutUpdateChan bool
+	clock             Clock
+	snapshotPath      string
+	snapshotSecret    []byte
+	snapshotAEAD      cipher.AEAD
+	snapshotVersion   uint64
+	auditSize         int
+	apiLock           sync.Mutex
+	api               controllerAPI
+	controllerVersion string
+	auditLock         sync.Mutex
+	audit             []AuditEntry
+
+	broadcaster
+}
+
+// Option configures optional behavior of a ControllerManager.
+type Option func(*ControllerManager)
+
+// WithCredentialStore sets the store used to persist service credentials.
+// Credentials found in the store are used instead of asking the controller
+// for new ones.  If not set, a MemoryCredentialStore is used.
+func WithCredentialStore(store CredentialStore) Option {
+	return func(m *ControllerManager) {
+		m.credentialStore = store
+	}
+}
+
+// WithSelector sets which endpoints are tracked, replacing the
+// serviceTypes passed to NewControllerManager().  Set AllTypes in the
+// selector to track every type.
+func WithSelector(selector ServiceSelector) Option {
+	return func(m *ControllerManager) {
+		m.initialSelector = &selector
+	}
+}
+
+// WithTokenSource sets where the token used to talk to the controller comes
+// from.  When set, the token settings in Config are not used.
+func WithTokenSource(source TokenSource) Option {
+	return func(m *ControllerManager) {
+		m.tokenSource = source
+	}
+}
+
+// WithHTTPClient sets the client used to talk to the controller.  When set,
+// the TLS settings in Config are not used, so the client must already be
+// configured to trust the controller.  If not set, a client is made using
+// httputil.NewHTTPClient(), so it shares the app's client settings and
+// is traced.
+func WithHTTPClient(client *http.Client) Option {
+	return func(m *ControllerManager) {
+		m.httpClient = client
+	}
+}
+
+// WithClock sets the clock used to schedule syncs and retries, and to
+// expire credentials.  If not set, the system clock is used.
+func WithClock(clock Clock) Option {
+	return func(m *ControllerManager) {
+		m.clock = clock
+	}
+}
+
+// WithoutUpdateChan leaves UpdateChan nil.  Apps which only use Subscribe()
+// should set this, otherwise the unread UpdateChan will fill up and block
+// the manager.
+func WithoutUpdateChan() Option {
+	return func(m *ControllerManager) {
+		m.withoutUpdateChan = true
+	}
 }
 
 type controllerService struct {
-	URL         string
-	Name        string
-	Type        string
-	Annotations map[string]string
-	AgentName   string
-	Token       string
+	URL                  string
+	Name                 string
+	Type                 string
+	Annotations          map[string]string
+	AgentName            string
+	Token                string
+	Credential           ServiceCredential
+	CredentialsFetchedAt time.Time
+	Agent                AgentInfo
+	Stale                bool
 }
 
 // MakeControllerManager returns a new ControllerManager which will periodically poll
-// the controller for services, and send
+// the controller for services, and send updates on UpdateChan.
+//
+// It is the same as calling NewControllerManager() with context.Background(),
+// except an invalid config is fatal.
+//
+// Deprecated: use NewControllerManager(), which returns config errors.
 func MakeControllerManager(conf Config, serviceTypes []string) *ControllerManager {
+	m, err := NewControllerManager(context.Background(), conf, serviceTypes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+// NewControllerManager returns a new ControllerManager which will periodically poll
+// the controller for services, and send updates on UpdateChan.  Configured
+// endpoints of the given serviceTypes are tracked, unless WithSelector()
+// is used.  If serviceTypes is empty, nothing is tracked.
+//
+// The worker stops when ctx is cancelled or Shutdown() is called, whichever
+// happens first.  Any in-flight requests to the controller are cancelled as well,
+// and UpdateChan and all subscriptions are closed.
+//
+// If the config is not valid, the error from Config.Validate() is returned
+// and nothing is started.
+func NewControllerManager(ctx context.Context, conf Config, serviceTypes []string, opts ...Option) (*ControllerManager, error) {
 	conf.applyDefaults()
 	m := ControllerManager{
-		conf:              conf,
-		serviceTypes:      serviceTypes,
-		shutdownWorker:    make(chan bool),
-		updateRate:        time.Duration(conf.UpdateFrequencySeconds) * time.Second,
+		conf:             conf,
+		updateRate:       time.Duration(conf.UpdateFrequencySeconds) * time.Second,
+		watchResyncRate:  time.Duration(conf.WatchResyncSeconds) * time.Second,
+		maxCredentialAge: time.Duration(conf.MaxCredentialAgeSeconds) * time.Second,
+		syncNow:          make(chan struct{}, 1),
+		invalidated:      map[string]bool{},
+		pollBackoff: backoff{
+			min: time.Duration(conf.MinBackoffSeconds) * time.Second,
+			max: time.Duration(conf.MaxBackoffSeconds) * time.Second,
+		},
+		serviceRetries:    map[string]*serviceRetry{},
 		services:          map[string]controllerService{},
 		healthcheckStatus: fmt.Errorf("controller is not yet synced"),
-		UpdateChan:        make(chan ServiceUpdate, 10),
+		credentialStore:   NewMemoryCredentialStore(),
+		clock:             realClock{},
+	}
+	m.metrics = nopMetrics{}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	if err := conf.validate(m.tokenSource != nil); err != nil {
+		return nil, err
+	}
+	if m.initialSelector == nil {
+		m.initialSelector = &ServiceSelector{Types: serviceTypes}
+	}
+	selector, err := m.initialSelector.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid service selector: %v", err)
+	}
+	m.selector = selector
+	if m.snapshotPath != "" {
+		if err := m.loadSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+	if m.tokenSource == nil {
+		m.tokenSource = conf.tokenSource()
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	if !m.withoutUpdateChan {
+		m.UpdateChan = m.Subscribe(nil, SubscribeOptions{}).C
 	}
 
-	m.shutdownCount.Add(1)
+	m.shutdownCount.Add(2)
 	go m.worker()
-
-	return &m
+	if conf.Watch {
+		m.shutdownCount.Add(1)
+		go m.watcher()
+	}
+	go func() {
+		// Closing subscriptions also releases a worker blocked on a
+		// full subscription.
+		defer m.shutdownCount.Done()
+		<-m.ctx.Done()
+		m.closeSubscriptions()
+	}()
+
+	return &m, nil
 }
 
 // Shutdown tells the manager to stop doing updates and causes all
-// goprocs started to exit as cleanly as possible.
+// goprocs started to exit as cleanly as possible.  It is safe to call
+// more than once, and from multiple goroutines.  It returns once the
+// worker has exited and all subscriptions have been closed.
 func (m *ControllerManager) Shutdown() {
-	m.shutdownWorker <- true
-	close(m.UpdateChan)
+	m.shutdownOnce.Do(m.cancel)
 	m.shutdownCount.Wait()
 }
 
 func (m *ControllerManager) worker() {
+	defer m.shutdownCount.Done()
+
 	// Initialize but stop the timer before it triggers.
-	t := time.NewTimer(1 * time.Hour)
+	t := m.clock.NewTimer(1 * time.Hour)
 	t.Stop()
+	defer t.Stop()
 
-	m.reloadFromController()
-	t.Reset(m.updateRate)
-
+	m.replaySnapshot()
 	for {
+		m.syncLock.Lock()
+		_, delay, _ := m.reloadFromController(m.ctx)
+		m.syncLock.Unlock()
+		m.setNextAttempt(m.clock.Now().Add(delay))
+		t.Reset(delay)
+
 		select {
-		case <-m.shutdownWorker:
-			t.Stop()
-			m.shutdownCount.Done()
+		case <-m.ctx.Done():
 			return
-		case <-t.C:
-			m.reloadFromController()
-			t.Reset(m.updateRate)
+		case <-t.C():
+		case <-m.syncNow:
+			if !t.Stop() {
+				select {
+				case <-t.C():
+				default:
+				}
+			}
 		}
 	}
 }
 
-func (m *ControllerManager) reloadFromController() {
-	services, err := m.getArgoServices()
-	if err != nil {
-		m.healthcheckStatus = err
-		log.Printf("unable to get argo services from controller: %v", err)
+func (m *ControllerManager) setNextAttempt(when time.Time) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.nextAttempt = when
+}
+
+func (m *ControllerManager) setHealth(err error) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.healthcheckStatus = err
+}
+
+// NextAttempt returns when the next sync with the controller is
+// scheduled.  After a failure, this reflects the backoff delay, and
+// can be reported alongside Check().
+func (m *ControllerManager) NextAttempt() time.Time {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	return m.nextAttempt
+}
+
+// InvalidateCredentials marks the credentials for a service as no longer
+// valid, for example after the service answered with a 401.  New
+// credentials are requested from the controller right away, and a
+// ServiceUpdate with the new URL and token is sent once they arrive.
+// Unknown services are ignored.
+func (m *ControllerManager) InvalidateCredentials(agentName string, name string, serviceType string) {
+	key := serviceKey(agentName, name, serviceType)
+	m.servicesLock.RLock()
+	_, found := m.services[key]
+	m.servicesLock.RUnlock()
+	if !found {
 		return
 	}
-	m.healthcheckStatus = nil
+	m.invalidLock.Lock()
+	m.invalidated[key] = true
+	m.invalidLock.Unlock()
+	m.triggerSync()
+}
+
+// SetSelector changes which endpoints are tracked.  A sync happens right
+// away, sending adds for newly selected services and deletes for those no
+// longer selected.
+func (m *ControllerManager) SetSelector(selector ServiceSelector) error {
+	compiled, err := selector.compile()
+	if err != nil {
+		return err
+	}
+	m.selectorLock.Lock()
+	m.selector = compiled
+	m.selectorLock.Unlock()
+	m.triggerSync()
+	return nil
+}
 
-	// compare existing services to the new list.  We can assume that if we have an entry,
-	// we do not need to refresh tokens and the URL cannot change when talking to the
-	// controller.  If these change, we will want a restart.
+// Selector returns the selector currently in use.
+func (m *ControllerManager) Selector() ServiceSelector {
+	return m.currentSelector().ServiceSelector
+}
+
+func (m *ControllerManager) currentSelector() *compiledSelector {
+	m.selectorLock.Lock()
+	defer m.selectorLock.Unlock()
+	return m.selector
+}
+
+// triggerSync asks the worker to sync as soon as possible.  Multiple
+// requests made while a sync is running result in a single extra sync.
+func (m *ControllerManager) triggerSync() {
+	select {
+	case m.syncNow <- struct{}{}:
+	default:
+	}
+}
+
+func (m *ControllerManager) isInvalidated(key string) bool {
+	m.invalidLock.Lock()
+	defer m.invalidLock.Unlock()
+	return m.invalidated[key]
+}
+
+func (m *ControllerManager) clearInvalidated(key string) {
+	m.invalidLock.Lock()
+	defer m.invalidLock.Unlock()
+	delete(m.invalidated, key)
+}
+
+// credentialsExpired returns true if credentials fetched at the given time
+// are older than the configured maximum age.
+func (m *ControllerManager) credentialsExpired(fetchedAt time.Time) bool {
+	return m.maxCredentialAge > 0 && m.since(fetchedAt) >= m.maxCredentialAge
+}
+
+// reloadFromController syncs with the controller, and returns the changes
+// made and how long to wait before the next sync.  This is the configured
+// update rate, unless polling failed or a service credential request needs
+// to be retried sooner.  The error is from polling, or the last failed
+// credential request.  The caller must hold syncLock.
+func (m *ControllerManager) reloadFromController(ctx context.Context) (Diff, time.Duration, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "birger.sync",
+		trace.WithAttributes(attribute.String("birger.controller.url", m.conf.URL)))
+	defer span.End()
+	var diff Diff
+	started := m.clock.Now()
+	defer func() {
+		m.metrics.ObservePollDuration(m.since(started))
+		m.reportServicesTracked()
+		m.recordAudit(diff)
+	}()
+
+	services, err := m.getArgoServices(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return diff, m.updateRate, ctx.Err()
+		}
+		m.metrics.IncPollErrors(errorCause(err, PollErrorOther))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "fetching services")
+		m.setHealth(err)
+		delay := m.pollBackoff.next()
+		log.Printf("unable to get argo services from controller, retrying in %s: %v", delay, err)
+		return diff, delay, err
+	}
+	m.pollBackoff.reset()
+	m.setHealth(nil)
+
+	// Services on stale agents are either treated as gone, or kept and
+	// marked stale.  New services are not added until their agent pings.
+	staleKeys := map[string]bool{}
 	for key, fetchedService := range services {
-		if svc, found := m.services[key]; found {
-			if annotationsDifferent(svc, fetchedService) {
-				fetchedService.URL = svc.URL
-				fetchedService.Token = svc.Token
-				m.services[key] = fetchedService
-				m.sendUpdate(fetchedService)
+		if !fetchedService.Stale {
+			continue
+		}
+		_, found := m.services[key]
+		if m.conf.StaleAction == StaleActionDelete || !found {
+			staleKeys[key] = true
+			delete(services, key)
+		}
+	}
+
+	// compare existing services to the new list.  If we have an entry, we keep
+	// its URL and token unless they were invalidated or are older than the
+	// maximum credential age, in which case new ones are fetched and an update
+	// sent.  New entries use any credentials held in the credential store before
+	// asking the controller.  A failed credential request is retried with its own
+	// backoff, and does not prevent the other services from being processed.
+	for key, fetchedService := range services {
+		svc, found := m.services[key]
+		if found && !m.isInvalidated(key) && !m.credentialsExpired(svc.CredentialsFetchedAt) {
+			fetchedService.URL = svc.URL
+			fetchedService.Token = svc.Token
+			fetchedService.Credential = svc.Credential
+			fetchedService.CredentialsFetchedAt = svc.CredentialsFetchedAt
+			if mapsDifferent(svc.Annotations, fetchedService.Annotations) || agentDifferent(svc.Agent, fetchedService.Agent) || svc.Stale != fetchedService.Stale {
+				m.setService(key, fetchedService)
+				diff.Changed = append(diff.Changed, newServiceChange(svc.export(), fetchedService.export()))
+				op := OperationUpdate
+				if fetchedService.Stale && !svc.Stale {
+					op = OperationStale
+				}
+				if !m.sendUpdate(ctx, op, fetchedService) {
+					return diff, m.updateRate, ctx.Err()
+				}
+			} else {
+				// only the last ping changed, which is not worth an update.
+				m.refreshService(key, fetchedService)
 			}
 			continue
 		}
-		url, token, err := m.getTokenAndURL(fetchedService)
-		if err != nil {
-			m.healthcheckStatus = err
-			log.Printf("unable to fetch service credentials from controller: %v", err)
-			return
+		retry, retrying := m.serviceRetries[key]
+		if retrying && m.clock.Now().Before(retry.nextAttempt) {
+			continue
+		}
+		if found {
+			if err := m.credentialStore.Delete(key); err != nil {
+				log.Printf("unable to remove credentials for %s from store: %v", key, err)
+			}
+		}
+		creds, credErr := m.getCredentials(ctx, key, fetchedService)
+		if credErr != nil {
+			if ctx.Err() != nil {
+				return diff, m.updateRate, ctx.Err()
+			}
+			err = credErr
+			if !retrying {
+				retry = &serviceRetry{backoff: backoff{min: m.pollBackoff.min, max: m.pollBackoff.max}}
+				m.serviceRetries[key] = retry
+			}
+			delay := retry.backoff.next()
+			retry.nextAttempt = m.clock.Now().Add(delay)
+			span.RecordError(err, trace.WithAttributes(serviceAttributes(fetchedService)...))
+			span.SetStatus(codes.Error, "fetching service credentials")
+			m.setHealth(err)
+			log.Printf("unable to fetch service credentials for %s from controller, retrying in %s: %v", key, delay, err)
+			continue
+		}
+		delete(m.serviceRetries, key)
+		fetchedService.URL = creds.URL
+		fetchedService.Token = creds.Token
+		fetchedService.Credential = creds.Credential
+		fetchedService.CredentialsFetchedAt = creds.FetchedAt
+		m.setService(key, fetchedService)
+		m.clearInvalidated(key)
+		op := OperationAdd
+		if found {
+			op = OperationUpdate
+			diff.Changed = append(diff.Changed, newServiceChange(svc.export(), fetchedService.export()))
+		} else {
+			diff.Added = append(diff.Added, fetchedService.export())
+		}
+		if !m.sendUpdate(ctx, op, fetchedService) {
+			return diff, m.updateRate, ctx.Err()
 		}
-		fetchedService.URL = url
-		fetchedService.Token = token
-		m.services[key] = fetchedService
-		m.sendUpdate(fetchedService)
 	}
 
 	// now, remove any we don't currently see.
@@ -140,59 +513,188 @@ func (m *ControllerManager) reloadFromController() {
 		if _, found := services[key]; found {
 			continue
 		}
-		m.sendDelete(service)
-		delete(m.services, key)
+		m.deleteService(key)
+		m.clearInvalidated(key)
+		diff.Removed = append(diff.Removed, service.export())
+		// keep the credentials of stale agents, as they will likely be back.
+		if !staleKeys[key] {
+			if err := m.credentialStore.Delete(key); err != nil {
+				log.Printf("unable to remove credentials for %s from store: %v", key, err)
+			}
+		}
+		if !m.sendDelete(ctx, service) {
+			return diff, m.updateRate, ctx.Err()
+		}
+	}
+
+	delay := m.pollInterval()
+	now := m.clock.Now()
+	for key, retry := range m.serviceRetries {
+		if _, found := services[key]; !found {
+			delete(m.serviceRetries, key)
+			continue
+		}
+		if d := retry.nextAttempt.Sub(now); d < delay {
+			delay = d
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	m.saveSnapshot()
+	return diff, delay, err
+}
+
+// getCredentials returns the stored credentials for the service if there
+// are any which have not expired, otherwise it asks the controller for new
+// ones and stores them.
+func (m *ControllerManager) getCredentials(ctx context.Context, key string, s controllerService) (Credentials, error) {
+	creds, found, err := m.credentialStore.Get(key)
+	if err != nil {
+		log.Printf("unable to read credentials for %s from store: %v", key, err)
+	}
+	if found && err == nil && !m.credentialsExpired(creds.FetchedAt) {
+		m.metrics.IncCredentialFetches(CredentialFetchStored)
+		if creds.Credential.Type == "" {
+			// stored before credentials had types.
+			creds.Credential = ServiceCredential{Type: CredentialPassword, Password: creds.Token}
+		}
+		return creds, nil
+	}
+
+	url, cred, err := m.fetchCredentials(ctx, s)
+	if err != nil {
+		m.metrics.IncCredentialFetches(CredentialFetchError)
+		return Credentials{}, err
+	}
+	m.metrics.IncCredentialFetches(CredentialFetchSuccess)
+	creds = Credentials{URL: url, Token: cred.bearerToken(), Credential: cred, FetchedAt: m.clock.Now()}
+	if err := m.credentialStore.Put(key, creds); err != nil {
+		log.Printf("unable to save credentials for %s to store: %v", key, err)
 	}
+	return creds, nil
+}
+
+func serviceKey(agentName string, name string, serviceType string) string {
+	return agentName + ":" + name + ":" + serviceType
+}
+
+// agentDifferent returns true if anything but the last ping time of the
+// agent has changed.
+func agentDifferent(a AgentInfo, b AgentInfo) bool {
+	return agentDetailsDifferent(a, b) || mapsDifferent(a.Annotations, b.Annotations)
 }
 
-func annotationsDifferent(a controllerService, b controllerService) bool {
-	if len(a.Annotations) != len(b.Annotations) {
+// agentDetailsDifferent is agentDifferent, ignoring annotations.
+func agentDetailsDifferent(a AgentInfo, b AgentInfo) bool {
+	return a.Session != b.Session ||
+		a.Hostname != b.Hostname ||
+		a.Version != b.Version ||
+		a.ConnectionType != b.ConnectionType ||
+		!a.ConnectedAt.Equal(b.ConnectedAt)
+}
+
+func mapsDifferent(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
 		return true
 	}
-	for k, v := range a.Annotations {
-		if v != b.Annotations[k] {
+	for k, v := range a {
+		if bv, found := b[k]; !found || v != bv {
 			return true
 		}
 	}
 	return false
 }
 
-func (m *ControllerManager) sendUpdate(s controllerService) {
-	m.UpdateChan <- ServiceUpdate{
-		Operation:   "update",
+// sendUpdate and sendDelete return false if ctx was cancelled before
+// the update could be delivered.
+func (m *ControllerManager) sendUpdate(ctx context.Context, op Operation, s controllerService) bool {
+	return m.send(ctx, ServiceUpdate{
+		Operation:   op,
 		Name:        s.Name,
 		Type:        s.Type,
 		AgentName:   s.AgentName,
 		Annotations: s.Annotations,
 		URL:         s.URL,
 		Token:       s.Token,
-	}
+		Credential:  s.Credential,
+		Agent:       s.Agent,
+		Stale:       s.Stale,
+	})
 }
 
-func (m *ControllerManager) sendDelete(s controllerService) {
-	m.UpdateChan <- ServiceUpdate{
-		Operation: "delete",
+func (m *ControllerManager) sendDelete(ctx context.Context, s controllerService) bool {
+	return m.send(ctx, ServiceUpdate{
+		Operation: OperationDelete,
 		Name:      s.Name,
 		Type:      s.Type,
 		AgentName: s.AgentName,
-	}
+	})
+}
+
+func (m *ControllerManager) send(ctx context.Context, u ServiceUpdate) bool {
+	m.publish(u)
+	return ctx.Err() == nil
 }
 
 // Check returns the last error received during a sync, if any.
 // Used for a healthcheck status.
 func (m *ControllerManager) Check() error {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
 	return m.healthcheckStatus
 }
 
 type connectedAgentsResponse struct {
+	ServerTime      int64            `json:"serverTime,omitempty"`
 	ConnectedAgents []connectedAgent `json:"connectedAgents,omitempty"`
 }
 
 type connectedAgent struct {
-	Name         string            `json:"name,omitempty"`
-	Annnotations map[string]string `json:"annotations,omitempty"`
-	Endpoints    []agentEndpoint   `json:"endpoints,omitempty"`
-	ConnectedAt  int64             `json:"connectedAt,omitempty"`
+	Name           string            `json:"name,omitempty"`
+	Session        string            `json:"session,omitempty"`
+	ConnectionType string            `json:"connectionType,omitempty"`
+	Annnotations   map[string]string `json:"annotations,omitempty"`
+	Endpoints      []agentEndpoint   `json:"endpoints,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	Hostname       string            `json:"hostname,omitempty"`
+	ConnectedAt    int64             `json:"connectedAt,omitempty"`
+	LastPing       int64             `json:"lastPing,omitempty"`
+	AgentInfo      struct {
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"agentInfo,omitempty"`
+}
+
+// info returns the agent details passed along with each of its services.
+// Annotations from agentInfo take precedence over any at the top level.
+func (a connectedAgent) info() AgentInfo {
+	var annotations map[string]string
+	if len(a.Annnotations) > 0 || len(a.AgentInfo.Annotations) > 0 {
+		annotations = map[string]string{}
+		for k, v := range a.Annnotations {
+			annotations[k] = v
+		}
+		for k, v := range a.AgentInfo.Annotations {
+			annotations[k] = v
+		}
+	}
+	return AgentInfo{
+		Name:           a.Name,
+		Session:        a.Session,
+		Hostname:       a.Hostname,
+		Version:        a.Version,
+		ConnectionType: a.ConnectionType,
+		ConnectedAt:    millisToTime(a.ConnectedAt),
+		LastPing:       millisToTime(a.LastPing),
+		Annotations:    annotations,
+	}
+}
+
+func millisToTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
 }
 
 type agentEndpoint struct {
@@ -209,172 +711,195 @@ type controllerServiceCredentialsRequest struct {
 }
 
 type controllerServiceCredentialResponse struct {
-	AgentName      string `json:"agentName,omitempty"`
-	Name           string `json:"name,omitempty"`
-	Type           string `json:"type,omitempty"`
-	CredentialType string `json:"credentialType,omitempty"`
-	Credential     struct {
-		Password string `json:"password,omitempty"`
-	} `json:"credential,omitempty"`
-	URL string `json:"url,omitempty"`
-}
-
-func (m *ControllerManager) makeRequest(method string, url string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
+	AgentName      string          `json:"agentName,omitempty"`
+	Name           string          `json:"name,omitempty"`
+	Type           string          `json:"type,omitempty"`
+	CredentialType string          `json:"credentialType,omitempty"`
+	Credential     json.RawMessage `json:"credential,omitempty"`
+	URL            string          `json:"url,omitempty"`
+}
+
+// doRequest sends a request to the controller.  If the controller rejects
+// the token, the token source is asked for a new one, and if it is different
+// the request is sent once more.
+func (m *ControllerManager) doRequest(ctx context.Context, client *http.Client, method string, url string, body []byte) (*http.Response, error) {
+	token, err := m.tokenSource.Token(ctx)
+	if err != nil {
+		return nil, withCause(PollErrorToken, fmt.Errorf("getting controller token: %v", err))
+	}
+	resp, err := m.sendRequest(ctx, client, method, url, body, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	newToken, err := m.tokenSource.Refresh(ctx)
+	if err != nil {
+		log.Printf("unable to refresh controller token: %v", err)
+		return resp, nil
+	}
+	if newToken == token {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return m.sendRequest(ctx, client, method, url, body, newToken)
+}
+
+func (m *ControllerManager) sendRequest(ctx context.Context, client *http.Client, method string, url string, body []byte, token string) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("content-type", "application/json")
-	req.Header.Set("authorization", "Bearer "+m.conf.Token)
-	return req, nil
+	req.Header.Set("authorization", "Bearer "+token)
+	return client.Do(req)
 }
 
-func (m *ControllerManager) getTokenAndURL(s controllerService) (serviceUrl string, serviceToken string, err error) {
-	url, err := url.JoinPath(m.conf.URL, "/api/v1/generateServiceCredentials")
-	if err != nil {
-		return
+func serviceAttributes(s controllerService) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("birger.agent.name", s.AgentName),
+		attribute.String("birger.service.name", s.Name),
+		attribute.String("birger.service.type", s.Type),
 	}
+}
 
-	client, err := m.getTLSClient()
-	//defer client.CloseIdleConnections()
+// fetchCredentials asks the controller for new credentials for a service.
+func (m *ControllerManager) fetchCredentials(ctx context.Context, s controllerService) (serviceURL string, cred ServiceCredential, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "birger.fetchCredentials", trace.WithAttributes(serviceAttributes(s)...))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "fetching service credentials")
+		}
+		span.End()
+	}()
+
+	api, err := m.getAPI(ctx)
 	if err != nil {
-		return "", "", fmt.Errorf("making TLS client: %v", err)
+		return "", ServiceCredential{}, err
 	}
 
-	credentialsRequest := controllerServiceCredentialsRequest{
-		AgentName: s.AgentName,
-		Name:      s.Name,
-		Type:      s.Type,
+	url, err := url.JoinPath(m.conf.URL, api.credentialsPath())
+	if err != nil {
+		return "", ServiceCredential{}, fmt.Errorf("joining url: %v", err)
 	}
 
-	d, err := json.Marshal(credentialsRequest)
+	client, err := m.getHTTPClient()
 	if err != nil {
-		return
+		return "", ServiceCredential{}, fmt.Errorf("making TLS client: %v", err)
 	}
-	r := bytes.NewReader(d)
-	req, err := m.makeRequest(http.MethodPost, url, r)
+
+	d, err := api.credentialsRequest(s)
 	if err != nil {
-		return
+		return "", ServiceCredential{}, err
 	}
-	resp, err := client.Do(req)
+	resp, err := m.doRequest(ctx, client, http.MethodPost, url, d)
 	if err != nil {
 		client.CloseIdleConnections()
-		return "", "", fmt.Errorf("fetching service credentials: %v", err)
+		return "", ServiceCredential{}, fmt.Errorf("fetching service credentials: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("fetching service credentials: http status %d", resp.StatusCode)
+		return "", ServiceCredential{}, fmt.Errorf("fetching service credentials: http status %d", resp.StatusCode)
 	}
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", "", fmt.Errorf("reading body: %v", err)
+		return "", ServiceCredential{}, fmt.Errorf("reading body: %v", err)
 	}
 
-	var creds controllerServiceCredentialResponse
-	err = json.Unmarshal(data, &creds)
-	if err != nil {
-		return "", "", fmt.Errorf("cannot decode service credentials JSON: %v", err)
-	}
-
-	return creds.URL, creds.Credential.Password, nil
+	return api.parseCredentials(data)
 }
 
-func (m *ControllerManager) getArgoServices() (map[string]controllerService, error) {
-	url, err := url.JoinPath(m.conf.URL, "/api/v1/getAgentStatistics")
+func (m *ControllerManager) getArgoServices(ctx context.Context) (map[string]controllerService, error) {
+	api, err := m.getAPI(ctx)
 	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("joining url: %v", err)
+		return map[string]controllerService{}, err
 	}
 
-	client, err := m.getTLSClient()
-	//defer client.CloseIdleConnections()
+	url, err := url.JoinPath(m.conf.URL, api.agentsPath())
 	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("making TLS client: %v", err)
+		return map[string]controllerService{}, fmt.Errorf("joining url: %v", err)
 	}
 
-	req, err := m.makeRequest(http.MethodGet, url, nil)
+	client, err := m.getHTTPClient()
 	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("making connected agents request: %v", err)
+		return map[string]controllerService{}, withCause(PollErrorTLS, fmt.Errorf("making TLS client: %v", err))
 	}
 
-	resp, err := client.Do(req)
+	resp, err := m.doRequest(ctx, client, http.MethodGet, url, nil)
 	if err != nil {
 		client.CloseIdleConnections()
-		return map[string]controllerService{}, fmt.Errorf("fetching connected agents: %v", err)
+		return map[string]controllerService{}, withCause(errorCause(err, PollErrorRequest), fmt.Errorf("fetching connected agents: %v", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return map[string]controllerService{}, fmt.Errorf("fetching connnected agents: http status %d", resp.StatusCode)
+		if resp.StatusCode == http.StatusNotFound {
+			m.resetAPI()
+		}
+		return map[string]controllerService{}, withCause(PollErrorStatus, fmt.Errorf("fetching connnected agents: http status %d", resp.StatusCode))
 	}
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("reading body: %v", err)
+		return map[string]controllerService{}, withCause(PollErrorRequest, fmt.Errorf("reading body: %v", err))
 	}
 
-	return m.parseAgentStatistics(data)
+	services, err := m.parseAgents(api, data)
+	if err != nil {
+		return services, withCause(PollErrorDecode, err)
+	}
+	return services, nil
 }
 
-type serviceList struct {
-	connectedAt int64
-	endpoints   []agentEndpoint
+// parseAgentStatistics parses a v1 agent statistics response.
+func (m *ControllerManager) parseAgentStatistics(data []byte) (map[string]controllerService, error) {
+	return m.parseAgents(apiV1{}, data)
 }
 
-func (m *ControllerManager) parseAgentStatistics(data []byte) (map[string]controllerService, error) {
-	var ca connectedAgentsResponse
-	err := json.Unmarshal(data, &ca)
+// parseAgents returns the selected services of the agents in an agents
+// response.
+func (m *ControllerManager) parseAgents(api controllerAPI, data []byte) (map[string]controllerService, error) {
+	ca, err := api.parseAgents(data)
 	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("cannot decode connected agent JSON: %v", err)
+		return map[string]controllerService{}, err
 	}
 
-	newestAgents := map[string]serviceList{}
+	newestAgents := map[string]connectedAgent{}
 	// Find the newest versions of each agent, based on connect time.
 	for _, a := range ca.ConnectedAgents {
 		f, found := newestAgents[a.Name]
-		if !found || f.connectedAt < a.ConnectedAt {
-			newestAgents[a.Name] = serviceList{
-				connectedAt: a.ConnectedAt,
-				endpoints:   a.Endpoints,
-			}
+		if !found || f.ConnectedAt < a.ConnectedAt {
+			newestAgents[a.Name] = a
 		}
 	}
 
 	endpoints := map[string]controllerService{}
 
+	selector := m.currentSelector()
 	for agentName, agent := range newestAgents {
-		for _, ep := range agent.endpoints {
-			if !ep.Configured || !util.Contains(m.serviceTypes, ep.Type) {
+		info := agent.info()
+		stale := m.agentStale(ca.ServerTime, agent.LastPing)
+		for _, ep := range agent.Endpoints {
+			if !selector.matches(info, ep) {
 				continue
 			}
-			key := agentName + ":" + ep.Name + ":" + ep.Type
-			endpoints[key] = controllerService{AgentName: agentName, Name: ep.Name, Type: ep.Type, Annotations: ep.Annnotations}
+			key := serviceKey(agentName, ep.Name, ep.Type)
+			endpoints[key] = controllerService{AgentName: agentName, Name: ep.Name, Type: ep.Type, Annotations: ep.Annnotations, Agent: info, Stale: stale}
 		}
 	}
 
 	return endpoints, nil
 }
 
-func (m *ControllerManager) getTLSClient() (*http.Client, error) {
-	if m.tlsClient == nil {
-		tlsConfig := &tls.Config{
-			MinVersion: tls.VersionTLS13,
-		}
-
-		tr := &http.Transport{
-			TLSClientConfig:       tlsConfig,
-			MaxIdleConns:          100,
-			MaxIdleConnsPerHost:   20,
-			IdleConnTimeout:       30 * time.Second,
-			DisableKeepAlives:     false,
-			TLSHandshakeTimeout:   5 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}
-
-		m.tlsClient = &http.Client{
-			Transport: tr,
-			Timeout:   20 * time.Second,
-		}
+// agentStale returns true if the agent has not pinged the controller within
+// the configured threshold.  Times are compared using the controller's clock.
+func (m *ControllerManager) agentStale(serverTime int64, lastPing int64) bool {
+	if m.conf.StaleAgentSeconds <= 0 || serverTime == 0 || lastPing == 0 {
+		return false
 	}
-
-	return m.tlsClient, nil
+	return serverTime-lastPing > int64(m.conf.StaleAgentSeconds)*1000
 }
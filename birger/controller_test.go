@@ -15,8 +15,23 @@
 package birger
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/utkarsh-opsmx/go-app-base/sse"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func Test_parseAgentStatistics(t *testing.T) {
@@ -76,6 +91,18 @@ func Test_parseAgentStatistics(t *testing.T) {
 					Annotations: map[string]string{
 						"description": "demo service",
 					},
+					Agent: AgentInfo{
+						Name:           "smith",
+						Session:        "0001HH270W7TD8DZZ6STNY2ASX",
+						Hostname:       "studio.local",
+						Version:        "v3.4.6-6-g4eee038",
+						ConnectionType: "direct",
+						ConnectedAt:    time.UnixMilli(1662065692965),
+						LastPing:       time.UnixMilli(1662067522916),
+						Annotations: map[string]string{
+							"description": "demo agent",
+						},
+					},
 				},
 			},
 			false,
@@ -174,6 +201,18 @@ func Test_parseAgentStatistics(t *testing.T) {
 						"description":     "demo service",
 						"otherAnnotation": "newer annotation",
 					},
+					Agent: AgentInfo{
+						Name:           "smith",
+						Session:        "session-one",
+						Hostname:       "studio.local",
+						Version:        "v3.4.6-6-g4eee038",
+						ConnectionType: "direct",
+						ConnectedAt:    time.UnixMilli(999),
+						LastPing:       time.UnixMilli(1662067522916),
+						Annotations: map[string]string{
+							"description": "demo agent",
+						},
+					},
 				},
 			},
 			false,
@@ -181,7 +220,9 @@ func Test_parseAgentStatistics(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := ControllerManager{serviceTypes: tt.filter}
+			selector, err := ServiceSelector{Types: tt.filter}.compile()
+			require.NoError(t, err)
+			m := ControllerManager{selector: selector}
 			got, err := m.parseAgentStatistics(tt.data)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseAgentStatistics() error = %v, wantErr %v", err, tt.wantErr)
@@ -193,3 +234,343 @@ func Test_parseAgentStatistics(t *testing.T) {
 		})
 	}
 }
+
+const testAgentStatistics = `{
+	"connectedAgents": [
+		{
+			"name": "smith",
+			"connectedAt": 1,
+			"endpoints": [
+				{"name": "whoami", "type": "whoami", "configured": true}
+			]
+		}
+	]
+}`
+
+type testController struct {
+	*httptest.Server
+	credentialRequests int32
+	statisticsRequests int32
+
+	sync.Mutex
+	statistics      string
+	failCredentials map[string]bool
+	requiredToken   string
+	events          chan string
+	rawEvents       chan string // written to the event stream as is
+}
+
+func newTestController(t *testing.T) *testController {
+	t.Helper()
+	c := &testController{
+		statistics:      testAgentStatistics,
+		failCredentials: map[string]bool{},
+		events:          make(chan string),
+		rawEvents:       make(chan string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/getAgentStatistics", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&c.statisticsRequests, 1)
+		c.Lock()
+		defer c.Unlock()
+		_, _ = w.Write([]byte(c.statistics))
+	})
+	mux.HandleFunc("/api/v1/generateServiceCredentials", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&c.credentialRequests, 1)
+		var req controllerServiceCredentialsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.Lock()
+		fail := c.failCredentials[req.Name]
+		c.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"url": "https://` + req.Name + `.example.com", "credentialType": "password", "credential": {"password": "secret"}}`))
+	})
+	mux.HandleFunc("/api/v1/streamAgentEvents", func(w http.ResponseWriter, r *http.Request) {
+		events := sse.NewSSE(nil)
+		w.Header().Set("content-type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_ = events.KeepAlive(w)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case name := <-c.events:
+				_ = events.Write(w, sse.Event{"event": name})
+			case raw := <-c.rawEvents:
+				_, _ = w.Write([]byte(raw))
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Lock()
+		required := c.requiredToken
+		c.Unlock()
+		if required != "" && r.Header.Get("authorization") != "Bearer "+required {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *testController) setRequiredToken(token string) {
+	c.Lock()
+	defer c.Unlock()
+	c.requiredToken = token
+}
+
+func (c *testController) setStatistics(statistics string) {
+	c.Lock()
+	defer c.Unlock()
+	c.statistics = statistics
+}
+
+func (c *testController) setFailCredentials(name string, fail bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.failCredentials[name] = fail
+}
+
+func TestControllerManager_Shutdown(t *testing.T) {
+	s := newTestController(t)
+
+	t.Run("can be called more than once", func(t *testing.T) {
+		m, err := NewControllerManager(context.Background(), Config{URL: s.URL, Token: "abc"}, []string{"whoami"})
+		require.NoError(t, err)
+		update := <-m.UpdateChan
+		require.Equal(t, "secret", update.Token)
+		m.Shutdown()
+		m.Shutdown()
+		_, ok := <-m.UpdateChan
+		require.False(t, ok)
+	})
+
+	t.Run("while an update is pending", func(t *testing.T) {
+		m, err := NewControllerManager(context.Background(), Config{URL: s.URL, Token: "abc"}, []string{"whoami"})
+		require.NoError(t, err)
+		done := make(chan bool)
+		for i := 0; i < 3; i++ {
+			go func() {
+				m.Shutdown()
+				done <- true
+			}()
+		}
+		for i := 0; i < 3; i++ {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Shutdown() did not return")
+			}
+		}
+	})
+
+	t.Run("context cancellation closes UpdateChan", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		m, err := NewControllerManager(ctx, Config{URL: s.URL, Token: "abc"}, []string{"whoami"})
+		require.NoError(t, err)
+		<-m.UpdateChan
+		cancel()
+		select {
+		case _, ok := <-m.UpdateChan:
+			require.False(t, ok)
+		case <-time.After(5 * time.Second):
+			t.Fatal("UpdateChan was not closed")
+		}
+		m.Shutdown()
+	})
+}
+
+func TestControllerManager_InvalidateCredentials(t *testing.T) {
+	c := newTestController(t)
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc"}, []string{"whoami"})
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	update := <-m.UpdateChan
+	require.Equal(t, OperationAdd, update.Operation)
+	require.Equal(t, int32(1), atomic.LoadInt32(&c.credentialRequests))
+
+	m.InvalidateCredentials("smith", "whoami", "whoami")
+	select {
+	case update = <-m.UpdateChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update after invalidating credentials")
+	}
+	require.Equal(t, OperationUpdate, update.Operation)
+	require.Equal(t, "secret", update.Token)
+	require.Equal(t, int32(2), atomic.LoadInt32(&c.credentialRequests))
+
+	// unknown services are not remembered, and do not cause a sync.
+	m.InvalidateCredentials("smith", "unknown", "whoami")
+	m.invalidLock.Lock()
+	require.Empty(t, m.invalidated)
+	m.invalidLock.Unlock()
+	require.Len(t, m.syncNow, 0)
+}
+
+func TestControllerManager_credentialsExpired(t *testing.T) {
+	m := ControllerManager{clock: realClock{}}
+	require.False(t, m.credentialsExpired(time.Now()))
+	m.maxCredentialAge = time.Minute
+	require.False(t, m.credentialsExpired(time.Now()))
+	require.True(t, m.credentialsExpired(time.Now().Add(-2*time.Minute)))
+}
+
+func TestControllerManager_credentialFailureDoesNotBlockOthers(t *testing.T) {
+	c := newTestController(t)
+	c.setStatistics(`{
+		"connectedAgents": [
+			{
+				"name": "smith",
+				"connectedAt": 1,
+				"endpoints": [
+					{"name": "broken", "type": "whoami", "configured": true},
+					{"name": "working", "type": "whoami", "configured": true}
+				]
+			}
+		]
+	}`)
+	c.setFailCredentials("broken", true)
+
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc", MinBackoffSeconds: 1}, []string{"whoami"})
+
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	update := <-m.UpdateChan
+	require.Equal(t, "working", update.Name)
+	// the retry is scheduled well before the 30 second update frequency.
+	require.Eventually(t, func() bool {
+		next := m.NextAttempt()
+		return !next.IsZero() && time.Until(next) < 2*time.Second
+	}, 5*time.Second, 10*time.Millisecond)
+
+	c.setFailCredentials("broken", false)
+	select {
+	case update = <-m.UpdateChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed service was not retried")
+	}
+	require.Equal(t, "broken", update.Name)
+}
+
+func TestControllerManager_spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		_ = provider.Shutdown(context.Background())
+	})
+
+	c := newTestController(t)
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc"}, []string{"whoami"})
+	require.NoError(t, err)
+	<-m.UpdateChan
+	m.Shutdown()
+
+	names := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		names[span.Name()] = span
+	}
+	require.Contains(t, names, "birger.sync")
+	require.Contains(t, names, "birger.fetchCredentials")
+	require.Contains(t, names["birger.fetchCredentials"].Attributes(), attribute.String("birger.agent.name", "smith"))
+}
+
+func TestControllerManager_agentChanges(t *testing.T) {
+	c := newTestController(t)
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc"}, []string{"whoami"})
+	require.NoError(t, err)
+	defer m.Shutdown()
+	<-m.UpdateChan
+	version := m.Version()
+
+	// a new ping alone does not send an update.
+	c.setStatistics(`{"connectedAgents": [{"name": "smith", "connectedAt": 1, "lastPing": 5,
+		"endpoints": [{"name": "whoami", "type": "whoami", "configured": true}]}]}`)
+	m.triggerSync()
+	require.Eventually(t, func() bool {
+		s, _ := m.Service("smith", "whoami", "whoami")
+		return s.Agent.LastPing.Equal(time.UnixMilli(5))
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, version, m.Version())
+
+	c.setStatistics(`{"connectedAgents": [{"name": "smith", "connectedAt": 1, "version": "v2",
+		"endpoints": [{"name": "whoami", "type": "whoami", "configured": true}]}]}`)
+	m.triggerSync()
+	update := <-m.UpdateChan
+	require.Equal(t, OperationUpdate, update.Operation)
+	require.Equal(t, "v2", update.Agent.Version)
+	require.Equal(t, "secret", update.Token)
+}
+
+func agentStatisticsPinged(serverTime int64, lastPing int64) string {
+	return fmt.Sprintf(`{"serverTime": %d, "connectedAgents": [{"name": "smith", "connectedAt": 1, "lastPing": %d,
+		"endpoints": [{"name": "whoami", "type": "whoami", "configured": true}]}]}`, serverTime, lastPing)
+}
+
+func TestControllerManager_staleAgents(t *testing.T) {
+	nextUpdate := func(t *testing.T, m *ControllerManager) ServiceUpdate {
+		t.Helper()
+		m.triggerSync()
+		select {
+		case u := <-m.UpdateChan:
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update")
+		}
+		return ServiceUpdate{}
+	}
+
+	t.Run("stale", func(t *testing.T) {
+		c := newTestController(t)
+		c.setStatistics(agentStatisticsPinged(100000, 99000))
+		m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc", StaleAgentSeconds: 10}, []string{"whoami"})
+		require.NoError(t, err)
+		defer m.Shutdown()
+		require.Equal(t, OperationAdd, (<-m.UpdateChan).Operation)
+
+		c.setStatistics(agentStatisticsPinged(200000, 99000))
+		u := nextUpdate(t, m)
+		require.Equal(t, OperationStale, u.Operation)
+		require.True(t, u.Stale)
+		s, found := m.Service("smith", "whoami", "whoami")
+		require.True(t, found)
+		require.True(t, s.Stale)
+
+		c.setStatistics(agentStatisticsPinged(200000, 199000))
+		u = nextUpdate(t, m)
+		require.Equal(t, OperationUpdate, u.Operation)
+		require.False(t, u.Stale)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		c := newTestController(t)
+		c.setStatistics(agentStatisticsPinged(100000, 99000))
+		conf := Config{URL: c.URL, Token: "abc", StaleAgentSeconds: 10, StaleAction: StaleActionDelete}
+		m, err := NewControllerManager(context.Background(), conf, []string{"whoami"})
+		require.NoError(t, err)
+		defer m.Shutdown()
+		require.Equal(t, OperationAdd, (<-m.UpdateChan).Operation)
+
+		c.setStatistics(agentStatisticsPinged(200000, 99000))
+		require.Equal(t, OperationDelete, nextUpdate(t, m).Operation)
+
+		c.setStatistics(agentStatisticsPinged(200000, 199000))
+		require.Equal(t, OperationAdd, nextUpdate(t, m).Operation)
+		// credentials were kept while the agent was stale.
+		require.Equal(t, int32(1), atomic.LoadInt32(&c.credentialRequests))
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// CredentialType says how a ServiceCredential is presented to a service.
+type CredentialType string
+
+const (
+	// CredentialPassword is sent as a bearer token.  It is what the
+	// controller has always issued, and the only type whose secret is
+	// also in the Token of a Service or ServiceUpdate, apart from
+	// CredentialBearer.
+	CredentialPassword CredentialType = "password"
+	// CredentialBearer is a Token sent as a bearer token.
+	CredentialBearer CredentialType = "bearer"
+	// CredentialBasic is a Username and Password for basic auth.
+	CredentialBasic CredentialType = "basic"
+	// CredentialMTLS is a client certificate and key, and the CA
+	// certificate to trust, all PEM encoded.
+	CredentialMTLS CredentialType = "mtls"
+)
+
+// ServiceCredential is the credential the controller issued for a service.
+// Which fields are set depends on Type.  For a type not listed above, Raw
+// holds the credential exactly as the controller sent it.
+type ServiceCredential struct {
+	Type           CredentialType  `json:"type,omitempty"`
+	Token          string          `json:"token,omitempty"`
+	Username       string          `json:"username,omitempty"`
+	Password       string          `json:"password,omitempty"`
+	CertificatePEM string          `json:"certificatePEM,omitempty"`
+	KeyPEM         string          `json:"keyPEM,omitempty"`
+	CACertPEM      string          `json:"caCertPEM,omitempty"`
+	Raw            json.RawMessage `json:"raw,omitempty"`
+}
+
+// wireCredential is the credential object in the controller's responses.
+type wireCredential struct {
+	Token       string `json:"token,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+	Key         string `json:"key,omitempty"`
+	CACert      string `json:"caCert,omitempty"`
+}
+
+// parseCredential decodes the credential object of the given type.  An
+// empty type is taken to be "password", as older controllers sent.
+func parseCredential(credentialType string, raw json.RawMessage) (ServiceCredential, error) {
+	if credentialType == "" {
+		credentialType = string(CredentialPassword)
+	}
+	ret := ServiceCredential{Type: CredentialType(credentialType)}
+	switch ret.Type {
+	case CredentialPassword, CredentialBearer, CredentialBasic, CredentialMTLS:
+	default:
+		ret.Raw = append(json.RawMessage{}, raw...)
+		return ret, nil
+	}
+
+	var wire wireCredential
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &wire); err != nil {
+			return ServiceCredential{}, fmt.Errorf("cannot decode %s credential JSON: %v", credentialType, err)
+		}
+	}
+	switch ret.Type {
+	case CredentialPassword:
+		ret.Password = wire.Password
+	case CredentialBearer:
+		ret.Token = wire.Token
+	case CredentialBasic:
+		ret.Username = wire.Username
+		ret.Password = wire.Password
+	case CredentialMTLS:
+		ret.CertificatePEM = wire.Certificate
+		ret.KeyPEM = wire.Key
+		ret.CACertPEM = wire.CACert
+	}
+	return ret, nil
+}
+
+// bearerToken returns the token to send as a bearer token, which is what
+// the Token field of a Service or ServiceUpdate has always held.
+func (c ServiceCredential) bearerToken() string {
+	switch c.Type {
+	case CredentialPassword:
+		return c.Password
+	case CredentialBearer:
+		return c.Token
+	}
+	return ""
+}
+
+func (c ServiceCredential) equal(o ServiceCredential) bool {
+	return c.Type == o.Type &&
+		c.Token == o.Token &&
+		c.Username == o.Username &&
+		c.Password == o.Password &&
+		c.CertificatePEM == o.CertificatePEM &&
+		c.KeyPEM == o.KeyPEM &&
+		c.CACertPEM == o.CACertPEM &&
+		bytes.Equal(c.Raw, o.Raw)
+}
+
+// redacted keeps only the type, for showing to people.
+func (c ServiceCredential) redacted() ServiceCredential {
+	return ServiceCredential{Type: c.Type}
+}
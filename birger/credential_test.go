@@ -0,0 +1,96 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCredential(t *testing.T) {
+	tests := []struct {
+		name           string
+		credentialType string
+		raw            string
+		want           ServiceCredential
+		wantToken      string
+		wantErr        bool
+	}{
+		{
+			"no type is password",
+			"",
+			`{"password": "secret"}`,
+			ServiceCredential{Type: CredentialPassword, Password: "secret"},
+			"secret",
+			false,
+		},
+		{
+			"bearer",
+			"bearer",
+			`{"token": "tok"}`,
+			ServiceCredential{Type: CredentialBearer, Token: "tok"},
+			"tok",
+			false,
+		},
+		{
+			"basic",
+			"basic",
+			`{"username": "u", "password": "p"}`,
+			ServiceCredential{Type: CredentialBasic, Username: "u", Password: "p"},
+			"",
+			false,
+		},
+		{
+			"mtls",
+			"mtls",
+			`{"certificate": "cert", "key": "key", "caCert": "ca"}`,
+			ServiceCredential{Type: CredentialMTLS, CertificatePEM: "cert", KeyPEM: "key", CACertPEM: "ca"},
+			"",
+			false,
+		},
+		{
+			"unknown type is kept raw",
+			"kerberos",
+			`{"ticket": "abc"}`,
+			ServiceCredential{Type: "kerberos", Raw: json.RawMessage(`{"ticket": "abc"}`)},
+			"",
+			false,
+		},
+		{
+			"bad json",
+			"basic",
+			`[]`,
+			ServiceCredential{},
+			"",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCredential(tt.credentialType, json.RawMessage(tt.raw))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.wantToken, got.bearerToken())
+			require.True(t, got.equal(tt.want))
+			require.Equal(t, ServiceCredential{Type: tt.want.Type}, got.redacted())
+		})
+	}
+}
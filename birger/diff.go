@@ -0,0 +1,117 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import "sort"
+
+// Diff describes the changes a single sync made to the tracked services.
+// Services which became stale, or stopped being stale, are in Changed.
+// Removed holds each service as it was last seen.
+type Diff struct {
+	Added   []Service       `json:"added,omitempty"`
+	Changed []ServiceChange `json:"changed,omitempty"`
+	Removed []Service       `json:"removed,omitempty"`
+}
+
+// ServiceChange describes how a single service changed.
+type ServiceChange struct {
+	Service            Service            `json:"service"` // as it is now
+	Annotations        []AnnotationChange `json:"annotations,omitempty"`
+	AgentAnnotations   []AnnotationChange `json:"agentAnnotations,omitempty"`
+	AgentChanged       bool               `json:"agentChanged,omitempty"` // the agent's details, other than annotations
+	CredentialsChanged bool               `json:"credentialsChanged,omitempty"`
+	StaleChanged       bool               `json:"staleChanged,omitempty"`
+}
+
+// AnnotationChange describes a single annotation which was added, removed,
+// or changed.  Before is nil for an added annotation, and After is nil for
+// a removed one.
+type AnnotationChange struct {
+	Key    string  `json:"key"`
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
+
+// Empty returns true if the sync changed nothing.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+// newServiceChange describes the change from before to after.
+func newServiceChange(before Service, after Service) ServiceChange {
+	return ServiceChange{
+		Service:            after,
+		Annotations:        diffAnnotations(before.Annotations, after.Annotations),
+		AgentAnnotations:   diffAnnotations(before.Agent.Annotations, after.Agent.Annotations),
+		AgentChanged:       agentDetailsDifferent(before.Agent, after.Agent),
+		CredentialsChanged: before.URL != after.URL || before.Token != after.Token || !before.Credential.equal(after.Credential),
+		StaleChanged:       before.Stale != after.Stale,
+	}
+}
+
+// diffAnnotations returns the annotations which differ between before and
+// after, sorted by key.
+func diffAnnotations(before map[string]string, after map[string]string) []AnnotationChange {
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	changes := []AnnotationChange{}
+	for k := range keys {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		if inBefore == inAfter && a == b {
+			continue
+		}
+		change := AnnotationChange{Key: k}
+		if inBefore {
+			change.Before = &b
+		}
+		if inAfter {
+			change.After = &a
+		}
+		changes = append(changes, change)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// redacted returns a copy of the diff without tokens or other secrets,
+// for showing to people.
+func (d Diff) redacted() Diff {
+	ret := Diff{}
+	for _, s := range d.Added {
+		s.Token = ""
+		s.Credential = s.Credential.redacted()
+		ret.Added = append(ret.Added, s)
+	}
+	for _, c := range d.Changed {
+		c.Service.Token = ""
+		c.Service.Credential = c.Service.Credential.redacted()
+		ret.Changed = append(ret.Changed, c)
+	}
+	for _, s := range d.Removed {
+		s.Token = ""
+		s.Credential = s.Credential.redacted()
+		ret.Removed = append(ret.Removed, s)
+	}
+	return ret
+}
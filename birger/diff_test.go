@@ -0,0 +1,69 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func strp(s string) *string {
+	return &s
+}
+
+func Test_diffAnnotations(t *testing.T) {
+	require.Nil(t, diffAnnotations(nil, map[string]string{}))
+	require.Nil(t, diffAnnotations(map[string]string{"a": "1"}, map[string]string{"a": "1"}))
+	require.Equal(t, []AnnotationChange{
+		{Key: "added", After: strp("new")},
+		{Key: "changed", Before: strp("old"), After: strp("new")},
+		{Key: "empty", Before: strp(""), After: nil},
+		{Key: "removed", Before: strp("old")},
+	}, diffAnnotations(
+		map[string]string{"changed": "old", "removed": "old", "same": "x", "empty": ""},
+		map[string]string{"changed": "new", "added": "new", "same": "x"},
+	))
+}
+
+func Test_newServiceChange(t *testing.T) {
+	before := Service{
+		Name:        "one",
+		URL:         "https://one",
+		Token:       "a",
+		Annotations: map[string]string{"env": "dev"},
+		Agent:       AgentInfo{Name: "smith", Session: "1", ConnectedAt: time.UnixMilli(1)},
+	}
+	after := before
+	after.Annotations = map[string]string{"env": "prod"}
+	after.Agent.LastPing = time.UnixMilli(5)
+	change := newServiceChange(before, after)
+	require.Equal(t, after, change.Service)
+	require.Equal(t, []AnnotationChange{{Key: "env", Before: strp("dev"), After: strp("prod")}}, change.Annotations)
+	require.False(t, change.AgentChanged)
+	require.False(t, change.CredentialsChanged)
+	require.False(t, change.StaleChanged)
+
+	after.Agent.Session = "2"
+	after.Agent.Annotations = map[string]string{"region": "us"}
+	after.Token = "b"
+	after.Stale = true
+	change = newServiceChange(before, after)
+	require.True(t, change.AgentChanged)
+	require.True(t, change.CredentialsChanged)
+	require.True(t, change.StaleChanged)
+	require.Equal(t, []AnnotationChange{{Key: "region", After: strp("us")}}, change.AgentAnnotations)
+}
@@ -0,0 +1,579 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ConflictPolicy decides what a FederatedManager does when more than one
+// controller has a service with the same agent, name, and type.
+type ConflictPolicy int
+
+const (
+	// ConflictNamespace keeps every service, prefixing the AgentName of
+	// each with its controller's name and a "/".
+	ConflictNamespace ConflictPolicy = iota
+	// ConflictPreferFirst keeps the service from the controller listed
+	// first.
+	ConflictPreferFirst
+	// ConflictPreferNewest keeps the service whose agent connected most
+	// recently, or the one from the controller listed first if they
+	// connected at the same time.
+	ConflictPreferNewest
+)
+
+// ControllerConfig describes one controller of a federation.
+type ControllerConfig struct {
+	// Name identifies the controller in Health(), and in agent names
+	// when using ConflictNamespace.  It must be unique and not contain "/".
+	Name   string
+	Config Config
+	// Options apply to this controller only, after those passed to
+	// NewFederatedManager().  Metrics should be set here, as each
+	// controller reports its own.
+	Options []Option
+}
+
+// FederationConfig lists the controllers a FederatedManager syncs with.
+type FederationConfig struct {
+	Controllers    []ControllerConfig
+	ConflictPolicy ConflictPolicy
+}
+
+// FederatedManager syncs with several controllers, for example one per
+// region, and presents their services as a single set.  Each controller
+// is polled by its own ControllerManager, so an outage of one does not
+// affect the services of the others.
+//
+// Updates are delivered to each Subscription, and to UpdateChan unless
+// WithoutUpdateChan() was used.  Each Service and ServiceUpdate has
+// Controller set to the name of the controller it came from.  Updates
+// which have not yet been published are combined per service, as for
+// OverflowCoalesce, so a slow subscriber sees the latest state rather
+// than every step.
+type FederatedManager struct {
+	UpdateChan    <-chan ServiceUpdate
+	policy        ConflictPolicy
+	controllers   []federatedController
+	ctx           context.Context
+	cancel        context.CancelFunc
+	shutdownOnce  sync.Once
+	shutdownCount sync.WaitGroup
+	// mergeLock is held while merging, so updates are queued in order,
+	// and by Sync() so its Diff includes everything it changed.
+	mergeLock       sync.Mutex
+	servicesLock    sync.RWMutex
+	services        map[string]federatedService
+	servicesVersion uint64
+
+	// merges queue their updates for publishLoop(), so a merge never
+	// waits for a subscriber.  Updates for the same service are combined,
+	// so at most one per service is pending.
+	pendingLock  sync.Mutex
+	pendingCond  *sync.Cond
+	pending      map[string]ServiceUpdate
+	pendingOrder []string
+	pendingKeys  map[string]bool // keys in pendingOrder
+
+	broadcaster
+}
+
+type federatedController struct {
+	name string
+	m    *ControllerManager
+}
+
+// federatedService is a merged service, and where it came from.
+type federatedService struct {
+	Service
+	controller *ControllerManager
+	agentName  string // as known to its controller
+}
+
+// NewFederatedManager returns a FederatedManager which syncs with each of
+// the controllers in conf.  The serviceTypes and opts apply to every
+// controller, as for NewControllerManager().  Credentials are kept apart
+// per controller, even when they share a CredentialStore.  Each
+// controller needs its own snapshot file, so WithSnapshotFile() must be
+// given in ControllerConfig.Options rather than in opts.
+//
+// The manager stops when ctx is cancelled or Shutdown() is called.  If any
+// controller's config is not valid, an error is returned and nothing is
+// started.
+func NewFederatedManager(ctx context.Context, conf FederationConfig, serviceTypes []string, opts ...Option) (*FederatedManager, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	if anyOption(opts, func(m *ControllerManager) bool { return m.snapshotPath != "" }) {
+		return nil, fmt.Errorf("WithSnapshotFile() must be set per controller, not for the whole federation")
+	}
+
+	// only the federation's own UpdateChan is affected by WithoutUpdateChan().
+	withoutUpdateChan := anyOption(opts, func(m *ControllerManager) bool { return m.withoutUpdateChan })
+
+	f := &FederatedManager{
+		policy:   conf.ConflictPolicy,
+		services: map[string]federatedService{},
+	}
+	f.pendingCond = sync.NewCond(&f.pendingLock)
+	f.pending = map[string]ServiceUpdate{}
+	f.pendingKeys = map[string]bool{}
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	for _, cc := range conf.Controllers {
+		childOpts := append([]Option{}, opts...)
+		childOpts = append(childOpts, cc.Options...)
+		childOpts = append(childOpts, WithoutUpdateChan(), withCredentialKeyPrefix(cc.Name+"/"))
+		m, err := NewControllerManager(f.ctx, cc.Config, serviceTypes, childOpts...)
+		if err != nil {
+			f.cancel()
+			for _, c := range f.controllers {
+				c.m.Shutdown()
+			}
+			return nil, fmt.Errorf("controller %s: %v", cc.Name, err)
+		}
+		f.controllers = append(f.controllers, federatedController{name: cc.Name, m: m})
+	}
+	if !withoutUpdateChan {
+		f.UpdateChan = f.subscribe(nil, SubscribeOptions{}).C
+	}
+
+	// any update from a controller causes a merge, which works out what
+	// changed from the controllers' current services.  Only the latest
+	// update matters, so a controller never waits for a merge.
+	for _, c := range f.controllers {
+		c.m.SubscribeFunc(nil, SubscribeOptions{BufferSize: 1, Overflow: OverflowDropOldest}, func(ServiceUpdate) {
+			f.merge()
+		})
+	}
+	// controllers may have synced, or loaded a snapshot, before the
+	// subscriptions were made.
+	f.merge()
+
+	f.shutdownCount.Add(2)
+	go f.publishLoop()
+	go func() {
+		defer f.shutdownCount.Done()
+		<-f.ctx.Done()
+		f.pendingLock.Lock()
+		f.pendingCond.Broadcast()
+		f.pendingLock.Unlock()
+		f.closeSubscriptions()
+		for _, c := range f.controllers {
+			c.m.Shutdown()
+		}
+	}()
+	return f, nil
+}
+
+func (conf FederationConfig) validate() error {
+	errs := []error{}
+	if len(conf.Controllers) == 0 {
+		errs = append(errs, fmt.Errorf("no controllers are configured"))
+	}
+	seen := map[string]bool{}
+	for i, cc := range conf.Controllers {
+		switch {
+		case cc.Name == "":
+			errs = append(errs, fmt.Errorf("controller %d has no name", i))
+		case strings.Contains(cc.Name, "/"):
+			errs = append(errs, fmt.Errorf("controller name %q contains a /", cc.Name))
+		case seen[cc.Name]:
+			errs = append(errs, fmt.Errorf("controller name %q is used more than once", cc.Name))
+		}
+		seen[cc.Name] = true
+	}
+	switch conf.ConflictPolicy {
+	case ConflictNamespace, ConflictPreferFirst, ConflictPreferNewest:
+	default:
+		errs = append(errs, fmt.Errorf("unknown conflict policy %d", conf.ConflictPolicy))
+	}
+	if len(errs) > 0 {
+		return &ConfigError{Errors: errs}
+	}
+	return nil
+}
+
+// Shutdown stops every controller's ControllerManager and closes all
+// subscriptions.  It is safe to call more than once, and from multiple
+// goroutines.
+func (f *FederatedManager) Shutdown() {
+	f.shutdownOnce.Do(f.cancel)
+	f.shutdownCount.Wait()
+}
+
+func (f *FederatedManager) merge() Diff {
+	f.mergeLock.Lock()
+	defer f.mergeLock.Unlock()
+	return f.mergeLocked()
+}
+
+// mergeLocked combines the services of all controllers according to the
+// conflict policy, queues an update for each change since the last merge,
+// and returns the changes.  Must be called with mergeLock held.
+func (f *FederatedManager) mergeLocked() Diff {
+	merged := map[string]federatedService{}
+	for _, c := range f.controllers {
+		for _, s := range c.m.Services() {
+			fs := federatedService{Service: s, controller: c.m, agentName: s.AgentName}
+			fs.Controller = c.name
+			if f.policy == ConflictNamespace {
+				fs.AgentName = c.name + "/" + s.AgentName
+			}
+			key := serviceKey(fs.AgentName, fs.Name, fs.Type)
+			if existing, found := merged[key]; found {
+				if f.policy != ConflictPreferNewest || !fs.Agent.ConnectedAt.After(existing.Agent.ConnectedAt) {
+					continue
+				}
+			}
+			merged[key] = fs
+		}
+	}
+
+	var diff Diff
+	updates := []ServiceUpdate{}
+	for _, key := range sortedKeys(merged) {
+		s := merged[key]
+		old, found := f.services[key]
+		switch {
+		case !found:
+			diff.Added = append(diff.Added, s.Service.copy())
+			updates = append(updates, s.update(OperationAdd))
+		case servicesDifferent(old.Service, s.Service):
+			diff.Changed = append(diff.Changed, newServiceChange(old.Service.copy(), s.Service.copy()))
+			op := OperationUpdate
+			if s.Stale && !old.Stale {
+				op = OperationStale
+			}
+			updates = append(updates, s.update(op))
+		}
+	}
+	for _, key := range sortedKeys(f.services) {
+		if _, found := merged[key]; found {
+			continue
+		}
+		old := f.services[key]
+		diff.Removed = append(diff.Removed, old.Service.copy())
+		updates = append(updates, old.update(OperationDelete))
+	}
+
+	// always keep the merged services, so changes which are not worth an
+	// update, such as the last ping, are still seen.
+	f.servicesLock.Lock()
+	f.services = merged
+	if len(updates) > 0 {
+		f.servicesVersion++
+	}
+	f.servicesLock.Unlock()
+
+	if len(updates) > 0 {
+		f.pendingLock.Lock()
+		for _, u := range updates {
+			f.queueUpdate(u)
+		}
+		f.pendingCond.Broadcast()
+		f.pendingLock.Unlock()
+	}
+	return diff
+}
+
+// queueUpdate adds u to the pending updates, combining it with any
+// already pending for the same service.  Must be called with pendingLock
+// held.
+func (f *FederatedManager) queueUpdate(u ServiceUpdate) {
+	key := u.key()
+	if queued, found := f.pending[key]; found {
+		if merged, keep := coalesceUpdates(queued, u); keep {
+			f.pending[key] = merged
+		} else {
+			delete(f.pending, key)
+		}
+		return
+	}
+	f.pending[key] = u
+	if !f.pendingKeys[key] {
+		f.pendingKeys[key] = true
+		f.pendingOrder = append(f.pendingOrder, key)
+	}
+}
+
+// nextUpdate removes and returns the oldest pending update.  Must be
+// called with pendingLock held.
+func (f *FederatedManager) nextUpdate() (ServiceUpdate, bool) {
+	for len(f.pendingOrder) > 0 {
+		key := f.pendingOrder[0]
+		f.pendingOrder = f.pendingOrder[1:]
+		delete(f.pendingKeys, key)
+		if u, found := f.pending[key]; found {
+			delete(f.pending, key)
+			return u, true
+		}
+	}
+	return ServiceUpdate{}, false
+}
+
+// publishLoop publishes pending updates in order until shutdown.  A
+// subscriber which is slow to read delays only later updates, not merges,
+// so it may call Sync() or any other method.
+func (f *FederatedManager) publishLoop() {
+	defer f.shutdownCount.Done()
+	for {
+		f.pendingLock.Lock()
+		for len(f.pending) == 0 && f.ctx.Err() == nil {
+			f.pendingCond.Wait()
+		}
+		if f.ctx.Err() != nil {
+			f.pendingLock.Unlock()
+			return
+		}
+		u, _ := f.nextUpdate()
+		f.pendingLock.Unlock()
+		f.publish(u)
+	}
+}
+
+func (s Service) update(op Operation) ServiceUpdate {
+	if op == OperationDelete {
+		return ServiceUpdate{
+			Operation:  op,
+			Name:       s.Name,
+			Type:       s.Type,
+			AgentName:  s.AgentName,
+			Controller: s.Controller,
+		}
+	}
+	return ServiceUpdate{
+		Operation:   op,
+		Name:        s.Name,
+		Type:        s.Type,
+		AgentName:   s.AgentName,
+		Annotations: s.Annotations,
+		URL:         s.URL,
+		Token:       s.Token,
+		Credential:  s.Credential,
+		Agent:       s.Agent,
+		Stale:       s.Stale,
+		Controller:  s.Controller,
+	}
+}
+
+// servicesDifferent returns true if anything but the last ping time of
+// the agent has changed.
+func servicesDifferent(a Service, b Service) bool {
+	return a.URL != b.URL ||
+		a.Token != b.Token ||
+		!a.Credential.equal(b.Credential) ||
+		a.Stale != b.Stale ||
+		a.Controller != b.Controller ||
+		mapsDifferent(a.Annotations, b.Annotations) ||
+		agentDifferent(a.Agent, b.Agent)
+}
+
+// Subscribe returns a new Subscription which receives updates matching
+// filter on its channel C.  It works as ControllerManager.Subscribe().
+func (f *FederatedManager) Subscribe(filter SubscriptionFilter, opts SubscribeOptions) *Subscription {
+	return f.subscribe(filter, opts)
+}
+
+// SubscribeFunc is like Subscribe, but calls fn for each update instead of
+// sending it on a channel.  It works as ControllerManager.SubscribeFunc().
+func (f *FederatedManager) SubscribeFunc(filter SubscriptionFilter, opts SubscribeOptions, fn func(ServiceUpdate)) *Subscription {
+	return f.subscribeFunc(filter, opts, fn)
+}
+
+// Sync syncs with every controller at once, and returns the changes made
+// to the merged services.  The error lists each controller which failed;
+// the Diff still holds the changes from the others.
+func (f *FederatedManager) Sync(ctx context.Context) (Diff, error) {
+	if f.ctx.Err() != nil {
+		return Diff{}, fmt.Errorf("federated manager is shut down")
+	}
+	f.mergeLock.Lock()
+	defer f.mergeLock.Unlock()
+
+	errs := make([]error, len(f.controllers))
+	var wg sync.WaitGroup
+	for i, c := range f.controllers {
+		wg.Add(1)
+		go func(i int, c federatedController) {
+			defer wg.Done()
+			if _, err := c.m.Sync(ctx); err != nil {
+				errs[i] = fmt.Errorf("controller %s: %v", c.name, err)
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	return f.mergeLocked(), joinErrors(errs)
+}
+
+// joinErrors combines the non-nil errors into one, or returns nil if
+// there are none.
+func joinErrors(errs []error) error {
+	msgs := []string{}
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// Health returns the result of Check() for each controller, by name.
+func (f *FederatedManager) Health() map[string]error {
+	ret := map[string]error{}
+	for _, c := range f.controllers {
+		ret[c.name] = c.m.Check()
+	}
+	return ret
+}
+
+// Check returns an error only if every controller is failing, so an outage
+// of one does not mark the app unhealthy.  Use Health() to report on each.
+func (f *FederatedManager) Check() error {
+	errs := make([]error, len(f.controllers))
+	for i, c := range f.controllers {
+		err := c.m.Check()
+		if err == nil {
+			return nil
+		}
+		errs[i] = fmt.Errorf("controller %s: %v", c.name, err)
+	}
+	return joinErrors(errs)
+}
+
+// InvalidateCredentials asks the controller the service came from for new
+// credentials, as ControllerManager.InvalidateCredentials() does.  The
+// agentName is as found in the federated Service.
+func (f *FederatedManager) InvalidateCredentials(agentName string, name string, serviceType string) {
+	f.servicesLock.RLock()
+	s, found := f.services[serviceKey(agentName, name, serviceType)]
+	f.servicesLock.RUnlock()
+	if found {
+		s.controller.InvalidateCredentials(s.agentName, name, serviceType)
+	}
+}
+
+// SetSelector changes which endpoints are tracked on every controller.
+func (f *FederatedManager) SetSelector(selector ServiceSelector) error {
+	if _, err := selector.compile(); err != nil {
+		return err
+	}
+	for _, c := range f.controllers {
+		if err := c.m.SetSelector(selector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version returns a counter which increases every time the set of merged
+// services, or any of their contents, changes.  As for
+// ControllerManager.Version(), a change to only the agent's LastPing does
+// not count.
+func (f *FederatedManager) Version() uint64 {
+	f.servicesLock.RLock()
+	defer f.servicesLock.RUnlock()
+	return f.servicesVersion
+}
+
+// Snapshot returns all merged services, sorted by agent, name, and type,
+// along with the Version() they correspond to.
+func (f *FederatedManager) Snapshot() ([]Service, uint64) {
+	f.servicesLock.RLock()
+	defer f.servicesLock.RUnlock()
+	return f.selectServices(func(Service) bool { return true }), f.servicesVersion
+}
+
+// Services returns all merged services, sorted by agent, name, and type.
+func (f *FederatedManager) Services() []Service {
+	services, _ := f.Snapshot()
+	return services
+}
+
+// ServicesByType returns the merged services of the given type, sorted
+// by agent and name.
+func (f *FederatedManager) ServicesByType(serviceType string) []Service {
+	f.servicesLock.RLock()
+	defer f.servicesLock.RUnlock()
+	return f.selectServices(func(s Service) bool { return s.Type == serviceType })
+}
+
+// Service returns a single merged service.  The boolean is false if the
+// service is not known.
+func (f *FederatedManager) Service(agentName string, name string, serviceType string) (Service, bool) {
+	f.servicesLock.RLock()
+	defer f.servicesLock.RUnlock()
+	s, found := f.services[serviceKey(agentName, name, serviceType)]
+	if !found {
+		return Service{}, false
+	}
+	return s.Service.copy(), true
+}
+
+// selectServices must be called with servicesLock held.
+func (f *FederatedManager) selectServices(match func(Service) bool) []Service {
+	ret := []Service{}
+	for _, s := range f.services {
+		if match(s.Service) {
+			ret = append(ret, s.Service.copy())
+		}
+	}
+	sortServices(ret)
+	return ret
+}
+
+// withCredentialKeyPrefix keeps the credentials of one controller apart
+// from those of others sharing the same CredentialStore.
+func withCredentialKeyPrefix(prefix string) Option {
+	return func(m *ControllerManager) {
+		m.credentialStore = prefixedCredentialStore{prefix: prefix, store: m.credentialStore}
+	}
+}
+
+// anyOption returns true if any of opts, applied on its own to an empty
+// ControllerManager, leaves it in a state for which set returns true.
+func anyOption(opts []Option, set func(*ControllerManager) bool) bool {
+	for _, opt := range opts {
+		var m ControllerManager
+		opt(&m)
+		if set(&m) {
+			return true
+		}
+	}
+	return false
+}
+
+type prefixedCredentialStore struct {
+	prefix string
+	store  CredentialStore
+}
+
+func (s prefixedCredentialStore) Get(key string) (Credentials, bool, error) {
+	return s.store.Get(s.prefix + key)
+}
+
+func (s prefixedCredentialStore) Put(key string, creds Credentials) error {
+	return s.store.Put(s.prefix+key, creds)
+}
+
+func (s prefixedCredentialStore) Delete(key string) error {
+	return s.store.Delete(s.prefix + key)
+}
@@ -0,0 +1,269 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFederation(t *testing.T, policy ConflictPolicy, controllers ...*testController) *FederatedManager {
+	t.Helper()
+	conf := FederationConfig{ConflictPolicy: policy}
+	for i, c := range controllers {
+		conf.Controllers = append(conf.Controllers, ControllerConfig{
+			Name:   string(rune('a' + i)),
+			Config: Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600},
+		})
+	}
+	f, err := NewFederatedManager(context.Background(), conf, []string{"whoami"})
+	require.NoError(t, err)
+	t.Cleanup(f.Shutdown)
+	return f
+}
+
+func federatedNames(services []Service) []string {
+	ret := []string{}
+	for _, s := range services {
+		ret = append(ret, s.Controller+" "+s.AgentName+" "+s.Name)
+	}
+	return ret
+}
+
+func TestFederatedManager_namespace(t *testing.T) {
+	c1 := newTestController(t)
+	c1.setStatistics(agentStatisticsWith("one"))
+	c2 := newTestController(t)
+	c2.setStatistics(agentStatisticsWith("one"))
+	f := newTestFederation(t, ConflictNamespace, c1, c2)
+
+	require.Eventually(t, func() bool { return len(f.Services()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"a a/smith one", "b b/smith one"}, federatedNames(f.Services()))
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		u := <-f.UpdateChan
+		require.Equal(t, OperationAdd, u.Operation)
+		seen[u.AgentName] = true
+	}
+	require.Equal(t, map[string]bool{"a/smith": true, "b/smith": true}, seen)
+
+	// invalidating goes to the controller the service came from.
+	before := atomic.LoadInt32(&c1.credentialRequests)
+	f.InvalidateCredentials("b/smith", "one", "whoami")
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&c2.credentialRequests) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, before, atomic.LoadInt32(&c1.credentialRequests))
+}
+
+func TestFederatedManager_preferFirst(t *testing.T) {
+	c1 := newTestController(t)
+	c1.setStatistics(agentStatisticsWith("one", "two"))
+	c2 := newTestController(t)
+	c2.setStatistics(agentStatisticsWith("one", "three"))
+	f := newTestFederation(t, ConflictPreferFirst, c1, c2)
+
+	diff, err := f.Sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, f.Services(), 3)
+	require.Equal(t, []string{"a smith one", "b smith three", "a smith two"}, federatedNames(f.Services()))
+
+	// when the first controller loses the service, the second one's is used.
+	c1.setStatistics(agentStatisticsWith("two"))
+	diff, err = f.Sync(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, diff.Added)
+	require.Empty(t, diff.Removed)
+	require.Len(t, diff.Changed, 1)
+	require.Equal(t, "b", diff.Changed[0].Service.Controller)
+
+	c2.setStatistics(agentStatisticsWith())
+	diff, err = f.Sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, diff.Removed, 2)
+	require.Equal(t, []string{"a smith two"}, federatedNames(f.Services()))
+}
+
+func TestFederatedManager_preferNewest(t *testing.T) {
+	c1 := newTestController(t)
+	c1.setStatistics(`{"connectedAgents": [{"name": "smith", "connectedAt": 1, "endpoints": [{"name": "one", "type": "whoami", "configured": true}]}]}`)
+	c2 := newTestController(t)
+	c2.setStatistics(`{"connectedAgents": [{"name": "smith", "connectedAt": 2, "endpoints": [{"name": "one", "type": "whoami", "configured": true}]}]}`)
+	f := newTestFederation(t, ConflictPreferNewest, c1, c2)
+
+	_, err := f.Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"b smith one"}, federatedNames(f.Services()))
+}
+
+func TestFederatedManager_health(t *testing.T) {
+	c1 := newTestController(t)
+	c2 := newTestController(t)
+	c2.setRequiredToken("other")
+	f := newTestFederation(t, ConflictNamespace, c1, c2)
+
+	_, err := f.Sync(context.Background())
+	require.ErrorContains(t, err, "controller b:")
+	require.NoError(t, f.Check())
+	health := f.Health()
+	require.NoError(t, health["a"])
+	require.Error(t, health["b"])
+
+	c1.setRequiredToken("other")
+	_, err = f.Sync(context.Background())
+	require.Error(t, err)
+	require.ErrorContains(t, f.Check(), "controller a:")
+	require.ErrorContains(t, f.Check(), "controller b:")
+}
+
+func TestFederationConfig_validate(t *testing.T) {
+	require.Error(t, FederationConfig{}.validate())
+	conf := FederationConfig{Controllers: []ControllerConfig{{Name: "a"}, {Name: "a"}, {Name: "x/y"}, {}}}
+	err := conf.validate()
+	require.Error(t, err)
+	require.Len(t, err.(*ConfigError).Errors, 3)
+	require.NoError(t, FederationConfig{Controllers: []ControllerConfig{{Name: "a"}}}.validate())
+}
+
+func TestNewFederatedManager_sharedSnapshotFile(t *testing.T) {
+	c := newTestController(t)
+	conf := FederationConfig{Controllers: []ControllerConfig{
+		{Name: "a", Config: Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}},
+		{Name: "b", Config: Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}},
+	}}
+	path := filepath.Join(t.TempDir(), "snapshot")
+	_, err := NewFederatedManager(context.Background(), conf, []string{"whoami"}, WithSnapshotFile(path, []byte("secret")))
+	require.Error(t, err)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFederatedManager_manyServicesAtStart(t *testing.T) {
+	names := []string{}
+	for i := 0; i < 12; i++ {
+		names = append(names, fmt.Sprintf("svc%02d", i))
+	}
+	c := newTestController(t)
+	c.setStatistics(agentStatisticsWith(names...))
+	path := filepath.Join(t.TempDir(), "snapshot")
+	secret := []byte("snapshot secret")
+
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}, []string{"whoami"}, WithSnapshotFile(path, secret), WithoutUpdateChan())
+	require.NoError(t, err)
+	_, err = m.Sync(context.Background())
+	require.NoError(t, err)
+	m.Shutdown()
+
+	// the snapshot's services are merged before anything reads UpdateChan.
+	conf := FederationConfig{Controllers: []ControllerConfig{{
+		Name:    "a",
+		Config:  Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600},
+		Options: []Option{WithSnapshotFile(path, secret)},
+	}}}
+	type result struct {
+		f   *FederatedManager
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		f, err := NewFederatedManager(context.Background(), conf, []string{"whoami"})
+		done <- result{f, err}
+	}()
+	var f *FederatedManager
+	select {
+	case r := <-done:
+		require.NoError(t, r.err)
+		f = r.f
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewFederatedManager did not return")
+	}
+	t.Cleanup(f.Shutdown)
+	require.Len(t, f.Services(), 12)
+
+	// Sync does not wait for UpdateChan to be read.
+	c.setStatistics(agentStatisticsWith(names[:1]...))
+	type syncResult struct {
+		diff Diff
+		err  error
+	}
+	synced := make(chan syncResult)
+	go func() {
+		diff, err := f.Sync(context.Background())
+		synced <- syncResult{diff, err}
+	}()
+	select {
+	case r := <-synced:
+		require.NoError(t, r.err)
+		require.Len(t, r.diff.Removed, 11)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not return")
+	}
+
+	// updates still pending are combined per service, so at most one per
+	// service is queued and a reader ends up with just the remaining one.
+	f.pendingLock.Lock()
+	require.LessOrEqual(t, len(f.pendingOrder), 12)
+	f.pendingLock.Unlock()
+	seen := map[string]bool{}
+	for {
+		select {
+		case u := <-f.UpdateChan:
+			seen[u.Name] = u.Operation != OperationDelete
+			continue
+		case <-time.After(200 * time.Millisecond):
+		}
+		break
+	}
+	for name, present := range seen {
+		require.Equal(t, name == names[0], present, name)
+	}
+	require.True(t, seen[names[0]])
+}
+
+func TestFederatedManager_queueUpdate(t *testing.T) {
+	f := &FederatedManager{pending: map[string]ServiceUpdate{}, pendingKeys: map[string]bool{}}
+	update := func(op Operation, name string, url string) ServiceUpdate {
+		return ServiceUpdate{Operation: op, Name: name, Type: "whoami", AgentName: "a/smith", URL: url, Controller: "a"}
+	}
+	for i := 0; i < 100; i++ {
+		f.queueUpdate(update(OperationAdd, "one", "u1"))
+		f.queueUpdate(update(OperationDelete, "one", ""))
+		f.queueUpdate(update(OperationUpdate, "two", fmt.Sprintf("u%d", i)))
+	}
+	f.queueUpdate(update(OperationDelete, "three", ""))
+	f.queueUpdate(update(OperationAdd, "three", "u3"))
+	require.Len(t, f.pendingOrder, 3)
+
+	u, found := f.nextUpdate()
+	require.True(t, found)
+	require.Equal(t, OperationUpdate, u.Operation)
+	require.Equal(t, "two", u.Name)
+	require.Equal(t, "u99", u.URL)
+	u, found = f.nextUpdate()
+	require.True(t, found)
+	require.Equal(t, OperationUpdate, u.Operation)
+	require.Equal(t, "three", u.Name)
+	_, found = f.nextUpdate()
+	require.False(t, found)
+	require.Empty(t, f.pendingKeys)
+}
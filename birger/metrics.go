@@ -0,0 +1,258 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Causes passed to Metrics.IncPollErrors.
+const (
+	PollErrorToken   = "token"   // no token for the controller
+	PollErrorTLS     = "tls"     // the TLS config could not be loaded
+	PollErrorRequest = "request" // the request failed or the body could not be read
+	PollErrorStatus  = "status"  // the controller returned a status other than 200
+	PollErrorDecode  = "decode"  // the controller's response was not understood
+	PollErrorOther   = "other"
+)
+
+// Results passed to Metrics.IncCredentialFetches.
+const (
+	CredentialFetchSuccess = "success" // fetched from the controller
+	CredentialFetchError   = "error"   // the controller request failed
+	CredentialFetchStored  = "stored"  // found in the credential store
+)
+
+// Metrics receives measurements from a ControllerManager.  Implementations
+// must be safe for concurrent use.  TextMetrics is one which serves them
+// in the Prometheus text format; others can adapt them to any metrics
+// library.
+type Metrics interface {
+	// ObservePollDuration is called after each sync with how long it took.
+	ObservePollDuration(d time.Duration)
+	// IncPollErrors is called when polling the controller fails.
+	IncPollErrors(cause string)
+	// IncCredentialFetches is called each time credentials are needed
+	// for a service.
+	IncCredentialFetches(result string)
+	// SetServicesTracked is called after each sync with the number of
+	// services tracked for each type.
+	SetServicesTracked(counts map[string]int)
+	// SetUpdateQueueDepth is called with the number of updates buffered
+	// across all subscriptions whenever it changes.
+	SetUpdateQueueDepth(depth int)
+}
+
+// WithMetrics sets where measurements are reported.  If not set, they are
+// discarded.
+func WithMetrics(metrics Metrics) Option {
+	return func(m *ControllerManager) {
+		m.metrics = metrics
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObservePollDuration(time.Duration) {}
+func (nopMetrics) IncPollErrors(string)              {}
+func (nopMetrics) IncCredentialFetches(string)       {}
+func (nopMetrics) SetServicesTracked(map[string]int) {}
+func (nopMetrics) SetUpdateQueueDepth(int)           {}
+
+// causeError tags an error with the cause reported to Metrics.  The
+// message is that of the wrapped error.
+type causeError struct {
+	cause string
+	err   error
+}
+
+func (e *causeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *causeError) Unwrap() error {
+	return e.err
+}
+
+func withCause(cause string, err error) error {
+	return &causeError{cause: cause, err: err}
+}
+
+// errorCause returns the cause err was tagged with, or fallback if none.
+func errorCause(err error, fallback string) string {
+	var ce *causeError
+	if errors.As(err, &ce) {
+		return ce.cause
+	}
+	return fallback
+}
+
+// reportServicesTracked sends the number of services of each type to
+// metrics.  Must be called during a sync.
+func (m *ControllerManager) reportServicesTracked() {
+	counts := map[string]int{}
+	for _, s := range m.services {
+		counts[s.Type]++
+	}
+	m.metrics.SetServicesTracked(counts)
+}
+
+// defaultPollBuckets are the upper bounds, in seconds, of the poll
+// duration histogram buckets.
+var defaultPollBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// TextMetrics keeps the measurements from a ControllerManager in memory,
+// and serves them in the Prometheus text exposition format.  It is an
+// http.Handler, usually mounted on /metrics.
+type TextMetrics struct {
+	lock              sync.Mutex
+	pollBuckets       []float64
+	pollBucketCounts  []uint64
+	pollCount         uint64
+	pollSum           float64
+	pollErrors        map[string]uint64
+	credentialFetches map[string]uint64
+	servicesTracked   map[string]int
+	updateQueueDepth  int
+}
+
+// NewTextMetrics returns an empty TextMetrics.
+func NewTextMetrics() *TextMetrics {
+	return &TextMetrics{
+		pollBuckets:       defaultPollBuckets,
+		pollBucketCounts:  make([]uint64, len(defaultPollBuckets)),
+		pollErrors:        map[string]uint64{},
+		credentialFetches: map[string]uint64{},
+		servicesTracked:   map[string]int{},
+	}
+}
+
+// ObservePollDuration implements Metrics.
+func (t *TextMetrics) ObservePollDuration(d time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	seconds := d.Seconds()
+	t.pollCount++
+	t.pollSum += seconds
+	for i, le := range t.pollBuckets {
+		if seconds <= le {
+			t.pollBucketCounts[i]++
+		}
+	}
+}
+
+// IncPollErrors implements Metrics.
+func (t *TextMetrics) IncPollErrors(cause string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pollErrors[cause]++
+}
+
+// IncCredentialFetches implements Metrics.
+func (t *TextMetrics) IncCredentialFetches(result string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.credentialFetches[result]++
+}
+
+// SetServicesTracked implements Metrics.  Types no longer tracked are
+// reported as 0 rather than disappearing.
+func (t *TextMetrics) SetServicesTracked(counts map[string]int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for serviceType := range t.servicesTracked {
+		t.servicesTracked[serviceType] = 0
+	}
+	for serviceType, n := range counts {
+		t.servicesTracked[serviceType] = n
+	}
+}
+
+// SetUpdateQueueDepth implements Metrics.
+func (t *TextMetrics) SetUpdateQueueDepth(depth int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.updateQueueDepth = depth
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (t *TextMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(t.String()))
+}
+
+// String returns all metrics in the Prometheus text format.
+func (t *TextMetrics) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var b strings.Builder
+	header := func(name string, metricType string, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	}
+
+	header("birger_poll_duration_seconds", "histogram", "Time taken to sync with the controller.")
+	for i, le := range t.pollBuckets {
+		fmt.Fprintf(&b, "birger_poll_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(le), t.pollBucketCounts[i])
+	}
+	fmt.Fprintf(&b, "birger_poll_duration_seconds_bucket{le=\"+Inf\"} %d\n", t.pollCount)
+	fmt.Fprintf(&b, "birger_poll_duration_seconds_sum %s\n", formatFloat(t.pollSum))
+	fmt.Fprintf(&b, "birger_poll_duration_seconds_count %d\n", t.pollCount)
+
+	header("birger_poll_errors_total", "counter", "Failed polls of the controller, by cause.")
+	for _, cause := range sortedKeys(t.pollErrors) {
+		fmt.Fprintf(&b, "birger_poll_errors_total{cause=\"%s\"} %d\n", escapeLabel(cause), t.pollErrors[cause])
+	}
+
+	header("birger_credential_fetches_total", "counter", "Service credentials needed, by result.")
+	for _, result := range sortedKeys(t.credentialFetches) {
+		fmt.Fprintf(&b, "birger_credential_fetches_total{result=\"%s\"} %d\n", escapeLabel(result), t.credentialFetches[result])
+	}
+
+	header("birger_services_tracked", "gauge", "Services currently tracked, by type.")
+	for _, serviceType := range sortedKeys(t.servicesTracked) {
+		fmt.Fprintf(&b, "birger_services_tracked{type=\"%s\"} %d\n", escapeLabel(serviceType), t.servicesTracked[serviceType])
+	}
+
+	header("birger_update_queue_depth", "gauge", "Updates buffered across all subscriptions.")
+	fmt.Fprintf(&b, "birger_update_queue_depth %d\n", t.updateQueueDepth)
+
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return fmt.Sprintf("%g", f)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextMetrics(t *testing.T) {
+	metrics := NewTextMetrics()
+	metrics.ObservePollDuration(20 * time.Millisecond)
+	metrics.ObservePollDuration(2 * time.Second)
+	metrics.IncPollErrors(PollErrorStatus)
+	metrics.IncCredentialFetches(CredentialFetchSuccess)
+	metrics.IncCredentialFetches(CredentialFetchSuccess)
+	metrics.SetServicesTracked(map[string]int{"argocd": 2, `we"ird`: 1})
+	metrics.SetServicesTracked(map[string]int{"argocd": 3})
+	metrics.SetUpdateQueueDepth(4)
+
+	want := `# HELP birger_poll_duration_seconds Time taken to sync with the controller.
+# TYPE birger_poll_duration_seconds histogram
+birger_poll_duration_seconds_bucket{le="0.005"} 0
+birger_poll_duration_seconds_bucket{le="0.01"} 0
+birger_poll_duration_seconds_bucket{le="0.025"} 1
+birger_poll_duration_seconds_bucket{le="0.05"} 1
+birger_poll_duration_seconds_bucket{le="0.1"} 1
+birger_poll_duration_seconds_bucket{le="0.25"} 1
+birger_poll_duration_seconds_bucket{le="0.5"} 1
+birger_poll_duration_seconds_bucket{le="1"} 1
+birger_poll_duration_seconds_bucket{le="2.5"} 2
+birger_poll_duration_seconds_bucket{le="5"} 2
+birger_poll_duration_seconds_bucket{le="10"} 2
+birger_poll_duration_seconds_bucket{le="+Inf"} 2
+birger_poll_duration_seconds_sum 2.02
+birger_poll_duration_seconds_count 2
+# HELP birger_poll_errors_total Failed polls of the controller, by cause.
+# TYPE birger_poll_errors_total counter
+birger_poll_errors_total{cause="status"} 1
+# HELP birger_credential_fetches_total Service credentials needed, by result.
+# TYPE birger_credential_fetches_total counter
+birger_credential_fetches_total{result="success"} 2
+# HELP birger_services_tracked Services currently tracked, by type.
+# TYPE birger_services_tracked gauge
+birger_services_tracked{type="argocd"} 3
+birger_services_tracked{type="we\"ird"} 0
+# HELP birger_update_queue_depth Updates buffered across all subscriptions.
+# TYPE birger_update_queue_depth gauge
+birger_update_queue_depth 4
+`
+	require.Equal(t, want, metrics.String())
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, want, string(body))
+	require.Contains(t, w.Result().Header.Get("content-type"), "text/plain")
+}
+
+func TestControllerManager_metrics(t *testing.T) {
+	c := newTestController(t)
+	c.setStatistics(agentStatisticsWith("one"))
+	metrics := NewTextMetrics()
+	conf := Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}
+	m, err := NewControllerManager(context.Background(), conf, []string{"whoami"}, WithMetrics(metrics), WithoutUpdateChan())
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	require.Eventually(t, func() bool { return len(m.Services()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	_, err = m.Sync(context.Background())
+	require.NoError(t, err)
+	out := metrics.String()
+	require.Contains(t, out, "birger_poll_duration_seconds_count 2\n")
+	require.Contains(t, out, `birger_services_tracked{type="whoami"} 1`+"\n")
+	require.Contains(t, out, `birger_credential_fetches_total{result="success"} 1`+"\n")
+
+	c.setRequiredToken("other")
+	_, err = m.Sync(context.Background())
+	require.Error(t, err)
+	require.Contains(t, metrics.String(), `birger_poll_errors_total{cause="status"} 1`+"\n")
+	c.setRequiredToken("")
+
+	// one update is held by the pump waiting on the unread channel, the
+	// rest are queued.
+	sub := m.Subscribe(nil, SubscribeOptions{})
+	c.setStatistics(agentStatisticsWith("one", "two", "three"))
+	_, err = m.Sync(context.Background())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return strings.Contains(metrics.String(), "birger_update_queue_depth 1\n")
+	}, 5*time.Second, 10*time.Millisecond)
+	<-sub.C
+	<-sub.C
+	require.Contains(t, metrics.String(), "birger_update_queue_depth 0\n")
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// These tests are mostly useful when run with -race.  They exercise the
+// public API from many goroutines while the worker is syncing.
+
+func agentStatisticsWith(names ...string) string {
+	endpoints := ""
+	for i, name := range names {
+		if i > 0 {
+			endpoints += ","
+		}
+		endpoints += fmt.Sprintf(`{"name": %q, "type": "whoami", "configured": true}`, name)
+	}
+	return `{"connectedAgents": [{"name": "smith", "connectedAt": 1, "endpoints": [` + endpoints + `]}]}`
+}
+
+func TestControllerManager_concurrentUse(t *testing.T) {
+	c := newTestController(t)
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc"}, []string{"whoami"})
+	require.NoError(t, err)
+	sub := m.Subscribe(nil, SubscribeOptions{BufferSize: 1, Overflow: OverflowDropOldest})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					f()
+				}
+			}
+		}()
+	}
+
+	run(func() { _ = m.Check() })
+	run(func() { _ = m.NextAttempt() })
+	run(func() { _ = m.Services() })
+	run(func() { _, _ = m.Service("smith", "a", "whoami") })
+	run(func() {
+		m.InvalidateCredentials("smith", "a", "whoami")
+		time.Sleep(time.Millisecond)
+	})
+	run(func() {
+		c.setStatistics(agentStatisticsWith("a", "b"))
+		time.Sleep(5 * time.Millisecond)
+		c.setStatistics(agentStatisticsWith("a"))
+		time.Sleep(5 * time.Millisecond)
+	})
+
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		for range m.UpdateChan {
+		}
+	}()
+	go func() {
+		for range sub.C {
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	var shutdowns sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		shutdowns.Add(1)
+		go func() {
+			defer shutdowns.Done()
+			m.Shutdown()
+		}()
+	}
+	shutdowns.Wait()
+	close(stop)
+	wg.Wait()
+
+	select {
+	case <-consumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("UpdateChan was not closed")
+	}
+}
+
+func TestControllerManager_shutdownWithUnreadUpdates(t *testing.T) {
+	c := newTestController(t)
+	c.setStatistics(agentStatisticsWith("a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"))
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc"}, []string{"whoami"})
+	require.NoError(t, err)
+
+	// nothing reads UpdateChan, so the worker will fill it and block.
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() blocked on a full UpdateChan")
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/utkarsh-opsmx/go-app-base/util"
+)
+
+// ServiceSelector chooses which agent endpoints a ControllerManager tracks.
+// An endpoint must match every field which is set.
+type ServiceSelector struct {
+	// Types lists the endpoint types to track.  If empty, no types match,
+	// unless AllTypes is set.
+	Types []string `json:"types,omitempty" yaml:"types,omitempty"`
+	// AllTypes tracks endpoints of every type, ignoring Types.
+	AllTypes bool `json:"allTypes,omitempty" yaml:"allTypes,omitempty"`
+	// AgentName is a glob, as used by path.Match(), for the agent name.
+	AgentName string `json:"agentName,omitempty" yaml:"agentName,omitempty"`
+	// EndpointName is a regular expression for the endpoint name.  It is
+	// not anchored, so use ^ and $ to match the whole name.
+	EndpointName string `json:"endpointName,omitempty" yaml:"endpointName,omitempty"`
+	// Labels and AgentLabels are label selectors, in the same syntax as
+	// Kubernetes, matched against the endpoint's and the agent's
+	// annotations.  See ParseLabelSelector().
+	Labels      string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	AgentLabels string `json:"agentLabels,omitempty" yaml:"agentLabels,omitempty"`
+	// IncludeUnconfigured also tracks endpoints the agent reports as
+	// not configured.
+	IncludeUnconfigured bool `json:"includeUnconfigured,omitempty" yaml:"includeUnconfigured,omitempty"`
+}
+
+// compiledSelector is a ServiceSelector ready for matching.
+type compiledSelector struct {
+	ServiceSelector
+	endpointName *regexp.Regexp
+	labels       LabelSelector
+	agentLabels  LabelSelector
+}
+
+func (s ServiceSelector) compile() (*compiledSelector, error) {
+	s.Types = append([]string(nil), s.Types...)
+	c := &compiledSelector{ServiceSelector: s}
+	if s.AgentName != "" {
+		if _, err := path.Match(s.AgentName, ""); err != nil {
+			return nil, fmt.Errorf("agentName: %v", err)
+		}
+	}
+	if s.EndpointName != "" {
+		re, err := regexp.Compile(s.EndpointName)
+		if err != nil {
+			return nil, fmt.Errorf("endpointName: %v", err)
+		}
+		c.endpointName = re
+	}
+	var err error
+	if c.labels, err = ParseLabelSelector(s.Labels); err != nil {
+		return nil, fmt.Errorf("labels: %v", err)
+	}
+	if c.agentLabels, err = ParseLabelSelector(s.AgentLabels); err != nil {
+		return nil, fmt.Errorf("agentLabels: %v", err)
+	}
+	return c, nil
+}
+
+func (s *compiledSelector) matches(agent AgentInfo, ep agentEndpoint) bool {
+	if !ep.Configured && !s.IncludeUnconfigured {
+		return false
+	}
+	if !s.AllTypes && !util.Contains(s.Types, ep.Type) {
+		return false
+	}
+	if s.AgentName != "" {
+		if ok, _ := path.Match(s.AgentName, agent.Name); !ok {
+			return false
+		}
+	}
+	if s.endpointName != nil && !s.endpointName.MatchString(ep.Name) {
+		return false
+	}
+	return s.labels.Matches(ep.Annnotations) && s.agentLabels.Matches(agent.Annotations)
+}
+
+// LabelSelector matches a set of labels (annotations, here) against a
+// list of requirements, all of which must be met.
+type LabelSelector []labelRequirement
+
+type labelOperator int
+
+const (
+	labelExists labelOperator = iota
+	labelNotExists
+	labelEquals
+	labelNotEquals
+	labelIn
+	labelNotIn
+)
+
+type labelRequirement struct {
+	key      string
+	operator labelOperator
+	values   []string
+}
+
+// ParseLabelSelector parses a Kubernetes-style label selector.  Requirements
+// are separated by commas, and each is one of:
+//
+//	key             the label is present
+//	!key            the label is not present
+//	key=value       also key==value
+//	key!=value      the label is not present, or has a different value
+//	key in (a,b)    the label has one of the values
+//	key notin (a,b) the label is not present, or has none of the values
+//
+// An empty selector matches everything.
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	ret := LabelSelector{}
+	for _, part := range splitRequirements(selector) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// splitRequirements splits on commas which are not inside parentheses.
+func splitRequirements(selector string) []string {
+	ret := []string{}
+	depth := 0
+	start := 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				ret = append(ret, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(ret, selector[start:])
+}
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_./]*[A-Za-z0-9])?$`)
+
+func parseRequirement(s string) (labelRequirement, error) {
+	if strings.HasPrefix(s, "!") {
+		return newRequirement(strings.TrimSpace(s[1:]), labelNotExists, nil)
+	}
+	if i := strings.Index(s, "!="); i >= 0 {
+		return newRequirement(s[:i], labelNotEquals, []string{s[i+2:]})
+	}
+	if i := strings.Index(s, "=="); i >= 0 {
+		return newRequirement(s[:i], labelEquals, []string{s[i+2:]})
+	}
+	if i := strings.Index(s, "="); i >= 0 {
+		return newRequirement(s[:i], labelEquals, []string{s[i+1:]})
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 1 {
+		return newRequirement(fields[0], labelExists, nil)
+	}
+	if len(fields) < 2 {
+		return labelRequirement{}, fmt.Errorf("invalid requirement %q", s)
+	}
+	key := fields[0]
+	rest := strings.TrimSpace(strings.TrimPrefix(s, key))
+	var op labelOperator
+	switch {
+	case strings.HasPrefix(rest, "notin"):
+		op = labelNotIn
+		rest = strings.TrimPrefix(rest, "notin")
+	case strings.HasPrefix(rest, "in"):
+		op = labelIn
+		rest = strings.TrimPrefix(rest, "in")
+	default:
+		return labelRequirement{}, fmt.Errorf("invalid requirement %q: unknown operator", s)
+	}
+	rest = strings.TrimSpace(rest)
+	if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+		return labelRequirement{}, fmt.Errorf("invalid requirement %q: values must be in parentheses", s)
+	}
+	values := []string{}
+	for _, v := range strings.Split(rest[1:len(rest)-1], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return labelRequirement{}, fmt.Errorf("invalid requirement %q: no values", s)
+	}
+	return newRequirement(key, op, values)
+}
+
+func newRequirement(key string, op labelOperator, values []string) (labelRequirement, error) {
+	key = strings.TrimSpace(key)
+	if !labelKeyPattern.MatchString(key) {
+		return labelRequirement{}, fmt.Errorf("invalid label key %q", key)
+	}
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return labelRequirement{key: key, operator: op, values: values}, nil
+}
+
+// Matches returns true if the labels meet every requirement.
+func (ls LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range ls {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	v, found := labels[r.key]
+	switch r.operator {
+	case labelExists:
+		return found
+	case labelNotExists:
+		return !found
+	case labelEquals, labelIn:
+		return found && util.Contains(r.values, v)
+	case labelNotEquals, labelNotIn:
+		return !found || !util.Contains(r.values, v)
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	labels := map[string]string{
+		"env":  "prod",
+		"tier": "web",
+	}
+	tests := []struct {
+		selector string
+		want     bool
+		wantErr  bool
+	}{
+		{"", true, false},
+		{"env", true, false},
+		{"!env", false, false},
+		{"!missing", true, false},
+		{"env=prod", true, false},
+		{"env==prod", true, false},
+		{"env=dev", false, false},
+		{"env!=dev", true, false},
+		{"missing!=dev", true, false},
+		{"env in (dev, prod)", true, false},
+		{"env in (dev,staging)", false, false},
+		{"env notin (dev,staging)", true, false},
+		{"missing notin (dev)", true, false},
+		{"env=prod,tier in (web,api)", true, false},
+		{"env=prod, tier=api", false, false},
+		{"env in dev", false, true},
+		{"env in ()", false, true},
+		{"env between (a,b)", false, true},
+		{"=prod", false, true},
+		{"bad key!=x", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			ls, err := ParseLabelSelector(tt.selector)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, ls.Matches(labels))
+		})
+	}
+}
+
+func TestServiceSelector_matches(t *testing.T) {
+	agent := AgentInfo{Name: "prod-east-1", Annotations: map[string]string{"region": "east"}}
+	ep := agentEndpoint{
+		Name:         "argocd-main",
+		Type:         "argocd",
+		Configured:   true,
+		Annnotations: map[string]string{"team": "platform"},
+	}
+	tests := []struct {
+		name     string
+		selector ServiceSelector
+		endpoint agentEndpoint
+		want     bool
+	}{
+		{"empty matches nothing", ServiceSelector{}, ep, false},
+		{"all types matches configured", ServiceSelector{AllTypes: true}, ep, true},
+		{"all types ignores types", ServiceSelector{AllTypes: true, Types: []string{"jenkins"}}, ep, true},
+		{"type", ServiceSelector{Types: []string{"jenkins", "argocd"}}, ep, true},
+		{"wrong type", ServiceSelector{Types: []string{"jenkins"}}, ep, false},
+		{"agent glob", ServiceSelector{AllTypes: true, AgentName: "prod-*"}, ep, true},
+		{"agent glob mismatch", ServiceSelector{AllTypes: true, AgentName: "dev-*"}, ep, false},
+		{"endpoint regex", ServiceSelector{AllTypes: true, EndpointName: "^argocd-"}, ep, true},
+		{"endpoint regex mismatch", ServiceSelector{AllTypes: true, EndpointName: "^main"}, ep, false},
+		{"labels", ServiceSelector{AllTypes: true, Labels: "team=platform"}, ep, true},
+		{"agent labels", ServiceSelector{AllTypes: true, AgentLabels: "region in (west)"}, ep, false},
+		{"unconfigured excluded", ServiceSelector{AllTypes: true}, agentEndpoint{Type: "argocd"}, false},
+		{"unconfigured included", ServiceSelector{AllTypes: true, IncludeUnconfigured: true}, agentEndpoint{Type: "argocd"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := tt.selector.compile()
+			require.NoError(t, err)
+			require.Equal(t, tt.want, c.matches(agent, tt.endpoint))
+		})
+	}
+
+	t.Run("survives serialisation", func(t *testing.T) {
+		for _, selector := range []ServiceSelector{{}, {AllTypes: true}} {
+			data, err := json.Marshal(selector)
+			require.NoError(t, err)
+			var got ServiceSelector
+			require.NoError(t, json.Unmarshal(data, &got))
+			c, err := got.compile()
+			require.NoError(t, err)
+			require.Equal(t, selector.AllTypes, c.matches(agent, ep))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ServiceSelector{AgentName: "["}.compile()
+		require.Error(t, err)
+		_, err = ServiceSelector{EndpointName: "("}.compile()
+		require.Error(t, err)
+		_, err = ServiceSelector{Labels: "a in b"}.compile()
+		require.Error(t, err)
+	})
+}
+
+func TestControllerManager_SetSelector(t *testing.T) {
+	c := newTestController(t)
+	c.setStatistics(agentStatisticsWith("alpha", "beta"))
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc"}, nil,
+		WithSelector(ServiceSelector{AllTypes: true, EndpointName: "^alpha$"}))
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	require.Equal(t, "alpha", (<-m.UpdateChan).Name)
+
+	require.Error(t, m.SetSelector(ServiceSelector{EndpointName: "("}))
+	require.NoError(t, m.SetSelector(ServiceSelector{AllTypes: true, EndpointName: "^beta$"}))
+	require.Equal(t, "^beta$", m.Selector().EndpointName)
+
+	got := map[string]Operation{}
+	for len(got) < 2 {
+		select {
+		case u := <-m.UpdateChan:
+			got[u.Name] = u.Operation
+		case <-time.After(5 * time.Second):
+			t.Fatal("selector change did not cause updates")
+		}
+	}
+	require.Equal(t, map[string]Operation{"alpha": OperationDelete, "beta": OperationAdd}, got)
+}
+
+func TestControllerManager_noServiceTypes(t *testing.T) {
+	c := newTestController(t)
+	c.setStatistics(agentStatisticsWith("alpha", "beta"))
+
+	// with no service types, nothing is tracked and no credentials are
+	// requested.
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}, nil, WithoutUpdateChan())
+	require.NoError(t, err)
+	defer m.Shutdown()
+	diff, err := m.Sync(context.Background())
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+	require.Empty(t, m.Services())
+	require.Equal(t, int32(0), atomic.LoadInt32(&c.credentialRequests))
+
+	// adding types to the current selector tracks them.
+	selector := m.Selector()
+	selector.Types = []string{"whoami"}
+	require.NoError(t, m.SetSelector(selector))
+	_, err = m.Sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, m.Services(), 2)
+
+	// a selector tracks every type only if it says so.
+	m2, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}, nil,
+		WithoutUpdateChan(), WithSelector(ServiceSelector{AllTypes: true}))
+	require.NoError(t, err)
+	defer m2.Shutdown()
+	_, err = m2.Sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, m2.Services(), 2)
+}
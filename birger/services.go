@@ -0,0 +1,174 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"sort"
+	"time"
+)
+
+// Service is a copy of a service currently known to the ControllerManager.
+// Changing it has no effect on the manager.
+type Service struct {
+	AgentName   string            `json:"agentName"`
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Annotations map[string]string `json:"annotations,omitempty"` // the endpoint's annotations
+	URL         string            `json:"url,omitempty"`
+	Token       string            `json:"token,omitempty"` // the bearer token, if Credential has one
+	Credential  ServiceCredential `json:"credential"`
+	Agent       AgentInfo         `json:"agent"`
+	Stale       bool              `json:"stale,omitempty"`      // True if the agent has not pinged recently
+	Controller  string            `json:"controller,omitempty"` // the controller's name, set only by a FederatedManager
+}
+
+// AgentInfo describes the agent a service is reached through.
+type AgentInfo struct {
+	Name           string            `json:"name"`
+	Session        string            `json:"session,omitempty"`
+	Hostname       string            `json:"hostname,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	ConnectionType string            `json:"connectionType,omitempty"`
+	ConnectedAt    time.Time         `json:"connectedAt"`
+	LastPing       time.Time         `json:"lastPing"`
+	Annotations    map[string]string `json:"annotations,omitempty"` // the agent's annotations
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (s controllerService) export() Service {
+	agent := s.Agent
+	agent.Annotations = copyMap(agent.Annotations)
+	return Service{
+		AgentName:   s.AgentName,
+		Name:        s.Name,
+		Type:        s.Type,
+		Annotations: copyMap(s.Annotations),
+		URL:         s.URL,
+		Token:       s.Token,
+		Credential:  s.Credential,
+		Agent:       agent,
+		Stale:       s.Stale,
+	}
+}
+
+// setService and deleteService are the only ways the worker changes the
+// services map, so the version always reflects a change.
+func (m *ControllerManager) setService(key string, s controllerService) {
+	m.servicesLock.Lock()
+	defer m.servicesLock.Unlock()
+	m.services[key] = s
+	m.servicesVersion++
+}
+
+// refreshService replaces the stored service without changing the version,
+// for changes which callers need not be told about.
+func (m *ControllerManager) refreshService(key string, s controllerService) {
+	m.servicesLock.Lock()
+	defer m.servicesLock.Unlock()
+	m.services[key] = s
+}
+
+func (m *ControllerManager) deleteService(key string) {
+	m.servicesLock.Lock()
+	defer m.servicesLock.Unlock()
+	delete(m.services, key)
+	m.servicesVersion++
+}
+
+// Version returns a counter which increases every time the set of known
+// services, or any of their contents, changes.  A change to only the
+// agent's LastPing does not count, so the version is not bumped by every
+// poll, though Services() shows the latest LastPing.
+func (m *ControllerManager) Version() uint64 {
+	m.servicesLock.RLock()
+	defer m.servicesLock.RUnlock()
+	return m.servicesVersion
+}
+
+// Snapshot returns all known services, sorted by agent, name, and type,
+// along with the Version() they correspond to.
+func (m *ControllerManager) Snapshot() ([]Service, uint64) {
+	m.servicesLock.RLock()
+	defer m.servicesLock.RUnlock()
+	return m.selectServices(func(controllerService) bool { return true }), m.servicesVersion
+}
+
+// Services returns all known services, sorted by agent, name, and type.
+func (m *ControllerManager) Services() []Service {
+	services, _ := m.Snapshot()
+	return services
+}
+
+// ServicesByType returns the known services of the given type, sorted
+// by agent and name.
+func (m *ControllerManager) ServicesByType(serviceType string) []Service {
+	m.servicesLock.RLock()
+	defer m.servicesLock.RUnlock()
+	return m.selectServices(func(s controllerService) bool { return s.Type == serviceType })
+}
+
+// Service returns a single known service.  The boolean is false if the
+// service is not known.
+func (m *ControllerManager) Service(agentName string, name string, serviceType string) (Service, bool) {
+	m.servicesLock.RLock()
+	defer m.servicesLock.RUnlock()
+	s, found := m.services[serviceKey(agentName, name, serviceType)]
+	if !found {
+		return Service{}, false
+	}
+	return s.export(), true
+}
+
+// selectServices must be called with servicesLock held.
+func (m *ControllerManager) selectServices(match func(controllerService) bool) []Service {
+	ret := []Service{}
+	for _, s := range m.services {
+		if match(s) {
+			ret = append(ret, s.export())
+		}
+	}
+	sortServices(ret)
+	return ret
+}
+
+// sortServices sorts by agent, name, and type.
+func sortServices(services []Service) {
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].AgentName != services[j].AgentName {
+			return services[i].AgentName < services[j].AgentName
+		}
+		if services[i].Name != services[j].Name {
+			return services[i].Name < services[j].Name
+		}
+		return services[i].Type < services[j].Type
+	})
+}
+
+// copy returns a Service which shares no maps with s.
+func (s Service) copy() Service {
+	s.Annotations = copyMap(s.Annotations)
+	s.Agent.Annotations = copyMap(s.Agent.Annotations)
+	return s
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestControllerManager_queries(t *testing.T) {
+	m := &ControllerManager{services: map[string]controllerService{}}
+	require.Empty(t, m.Services())
+	require.Equal(t, uint64(0), m.Version())
+
+	m.setService("smith:whoami:whoami", controllerService{
+		AgentName:   "smith",
+		Name:        "whoami",
+		Type:        "whoami",
+		Annotations: map[string]string{"description": "demo service"},
+		URL:         "https://whoami.example.com",
+		Token:       "secret",
+	})
+	m.setService("jones:argo:argocd", controllerService{AgentName: "jones", Name: "argo", Type: "argocd"})
+	m.setService("adams:argo:argocd", controllerService{AgentName: "adams", Name: "argo", Type: "argocd"})
+
+	services, version := m.Snapshot()
+	require.Equal(t, uint64(3), version)
+	require.Len(t, services, 3)
+	require.Equal(t, "adams", services[0].AgentName)
+	require.Equal(t, "jones", services[1].AgentName)
+	require.Equal(t, "smith", services[2].AgentName)
+
+	byType := m.ServicesByType("argocd")
+	require.Len(t, byType, 2)
+	require.Equal(t, "adams", byType[0].AgentName)
+
+	s, found := m.Service("smith", "whoami", "whoami")
+	require.True(t, found)
+	require.Equal(t, "https://whoami.example.com", s.URL)
+	require.Equal(t, "secret", s.Token)
+
+	t.Run("returns copies", func(t *testing.T) {
+		s.Annotations["description"] = "changed"
+		s, _ := m.Service("smith", "whoami", "whoami")
+		require.Equal(t, "demo service", s.Annotations["description"])
+	})
+
+	m.deleteService("smith:whoami:whoami")
+	_, found = m.Service("smith", "whoami", "whoami")
+	require.False(t, found)
+	require.Equal(t, uint64(4), m.Version())
+}
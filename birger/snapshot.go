@@ -0,0 +1,133 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// WithSnapshotFile keeps the last known services, including their
+// credentials, in a file at path so the app has services to use even if
+// the controller cannot be reached when it starts.  The file is encrypted
+// as for NewFileCredentialStore(), with a key derived from secret.
+//
+// Services found in the file are available from Services() right away,
+// and are sent as OperationAdd updates with Stale set before the first
+// sync.  Once a sync succeeds, those still present get an OperationUpdate
+// and those which are gone an OperationDelete, as usual.
+//
+// A FederatedManager should be given a different file for each controller
+// in ControllerConfig.Options.
+func WithSnapshotFile(path string, secret []byte) Option {
+	return func(m *ControllerManager) {
+		m.snapshotPath = path
+		m.snapshotSecret = secret
+	}
+}
+
+type snapshotFile struct {
+	SavedAt  time.Time           `json:"savedAt"`
+	Services []controllerService `json:"services"`
+}
+
+// loadSnapshot sets up encryption for the snapshot file, and loads any
+// services found in it as stale.  A missing or unreadable file is not an
+// error, as the controller will provide the services eventually.
+func (m *ControllerManager) loadSnapshot() error {
+	if len(m.snapshotSecret) == 0 {
+		return fmt.Errorf("snapshot file secret must not be empty")
+	}
+	aead, err := newAEAD(m.snapshotSecret)
+	if err != nil {
+		return err
+	}
+	m.snapshotAEAD = aead
+
+	data, err := os.ReadFile(m.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("unable to read service snapshot: %v", err)
+		return nil
+	}
+	plaintext, err := decrypt(aead, data)
+	if err != nil {
+		log.Printf("unable to read service snapshot %s: %v", m.snapshotPath, err)
+		return nil
+	}
+	var snapshot snapshotFile
+	if err := json.Unmarshal(plaintext, &snapshot); err != nil {
+		log.Printf("cannot decode service snapshot JSON: %v", err)
+		return nil
+	}
+
+	selector := m.currentSelector()
+	for _, s := range snapshot.Services {
+		ep := agentEndpoint{Name: s.Name, Type: s.Type, Annnotations: s.Annotations, Configured: true}
+		if !selector.matches(s.Agent, ep) {
+			continue
+		}
+		s.Stale = true
+		m.services[serviceKey(s.AgentName, s.Name, s.Type)] = s
+	}
+	log.Printf("loaded %d services from snapshot saved at %s", len(m.services), snapshot.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// replaySnapshot sends an update for each service loaded from the
+// snapshot.  It is called by the worker before the first sync.
+func (m *ControllerManager) replaySnapshot() {
+	services, _ := m.Snapshot()
+	for _, s := range services {
+		m.publish(s.update(OperationAdd))
+	}
+}
+
+// saveSnapshot writes the current services to the snapshot file if they
+// changed since it was last written.  Must be called during a sync.
+func (m *ControllerManager) saveSnapshot() {
+	if m.snapshotAEAD == nil {
+		return
+	}
+	version := m.Version()
+	if version == m.snapshotVersion {
+		return
+	}
+	snapshot := snapshotFile{SavedAt: m.clock.Now(), Services: []controllerService{}}
+	for _, s := range m.services {
+		snapshot.Services = append(snapshot.Services, s)
+	}
+	plaintext, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Printf("unable to encode service snapshot: %v", err)
+		return
+	}
+	data, err := encrypt(m.snapshotAEAD, plaintext)
+	if err != nil {
+		log.Printf("unable to encrypt service snapshot: %v", err)
+		return
+	}
+	if err := writeFileAtomic(m.snapshotPath, data); err != nil {
+		log.Printf("unable to write service snapshot: %v", err)
+		return
+	}
+	m.snapshotVersion = version
+}
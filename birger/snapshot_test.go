@@ -0,0 +1,90 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestControllerManager_snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	secret := []byte("snapshot secret")
+	c := newTestController(t)
+	c.setStatistics(agentStatisticsWith("one", "two"))
+	conf := Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}
+
+	m, err := NewControllerManager(context.Background(), conf, []string{"whoami"}, WithSnapshotFile(path, secret))
+	require.NoError(t, err)
+	<-m.UpdateChan
+	<-m.UpdateChan
+	_, err = m.Sync(context.Background())
+	require.NoError(t, err)
+	m.Shutdown()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "secret")
+	require.NotContains(t, string(data), "example.com")
+
+	// the controller is unreachable, so the snapshot is all there is.
+	c.setRequiredToken("other")
+	m, err = NewControllerManager(context.Background(), conf, []string{"whoami"}, WithSnapshotFile(path, secret))
+	require.NoError(t, err)
+	defer m.Shutdown()
+	require.Len(t, m.Services(), 2)
+	for _, name := range []string{"one", "two"} {
+		update := <-m.UpdateChan
+		require.Equal(t, OperationAdd, update.Operation)
+		require.Equal(t, name, update.Name)
+		require.True(t, update.Stale)
+		require.Equal(t, "secret", update.Token)
+		require.Equal(t, "https://"+name+".example.com", update.URL)
+	}
+	require.Eventually(t, func() bool { return m.Check() != nil && !m.NextAttempt().IsZero() }, 5*time.Second, 10*time.Millisecond)
+
+	c.setRequiredToken("")
+	c.setStatistics(agentStatisticsWith("one"))
+	diff, err := m.Sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, diff.Changed, 1)
+	require.False(t, diff.Changed[0].Service.Stale)
+	require.True(t, diff.Changed[0].StaleChanged)
+	require.False(t, diff.Changed[0].CredentialsChanged)
+	require.Len(t, diff.Removed, 1)
+	require.Equal(t, "two", diff.Removed[0].Name)
+}
+
+func TestControllerManager_snapshotErrors(t *testing.T) {
+	c := newTestController(t)
+	conf := Config{URL: c.URL, Token: "abc", UpdateFrequencySeconds: 3600}
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	_, err := NewControllerManager(context.Background(), conf, []string{"whoami"}, WithSnapshotFile(path, nil))
+	require.Error(t, err)
+
+	// an unreadable snapshot is ignored.
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0600))
+	m, err := NewControllerManager(context.Background(), conf, []string{"whoami"}, WithSnapshotFile(path, []byte("secret")))
+	require.NoError(t, err)
+	defer m.Shutdown()
+	update := <-m.UpdateChan
+	require.False(t, update.Stale)
+}
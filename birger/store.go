@@ -0,0 +1,254 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Credentials holds the URL and token issued by the controller for
+// a single service, and when they were issued.
+type Credentials struct {
+	URL        string            `json:"url,omitempty"`
+	Token      string            `json:"token,omitempty"`
+	Credential ServiceCredential `json:"credential,omitempty"`
+	FetchedAt  time.Time         `json:"fetchedAt,omitempty"`
+}
+
+// CredentialStore persists service credentials so they need not be
+// requested from the controller again after a restart.  Keys are in
+// the form "agent:name:type".
+//
+// Implementations must be safe for concurrent use.
+type CredentialStore interface {
+	// Get returns the stored credentials for key.  The boolean is false
+	// if no credentials are stored for that key.
+	Get(key string) (Credentials, bool, error)
+	// Put stores the credentials for key, replacing any existing entry.
+	Put(key string, creds Credentials) error
+	// Delete removes any stored credentials for key.  Deleting a key
+	// which is not present is not an error.
+	Delete(key string) error
+}
+
+// MemoryCredentialStore is a CredentialStore which keeps credentials only
+// for the lifetime of the process.  This is the default used by
+// ControllerManager.
+type MemoryCredentialStore struct {
+	sync.Mutex
+	creds map[string]Credentials
+}
+
+var _ CredentialStore = &MemoryCredentialStore{}
+
+// NewMemoryCredentialStore returns an empty MemoryCredentialStore.
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{creds: map[string]Credentials{}}
+}
+
+// Get implements CredentialStore.
+func (s *MemoryCredentialStore) Get(key string) (Credentials, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	c, found := s.creds[key]
+	return c, found, nil
+}
+
+// Put implements CredentialStore.
+func (s *MemoryCredentialStore) Put(key string, creds Credentials) error {
+	s.Lock()
+	defer s.Unlock()
+	s.creds[key] = creds
+	return nil
+}
+
+// Delete implements CredentialStore.
+func (s *MemoryCredentialStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.creds, key)
+	return nil
+}
+
+// FileCredentialStore is a CredentialStore which keeps credentials in
+// a single file on disk, encrypted with AES-256-GCM.  The whole file is
+// rewritten on every change, which is fine for the handful of services
+// an app will generally track.
+type FileCredentialStore struct {
+	sync.Mutex
+	path  string
+	aead  cipher.AEAD
+	creds map[string]Credentials
+}
+
+var _ CredentialStore = &FileCredentialStore{}
+
+// NewFileCredentialStore returns a FileCredentialStore backed by path.
+// The encryption key is derived from secret, which should be the same
+// across restarts (a mounted secret, for example) or the existing file
+// cannot be read.
+//
+// If path does not exist, the store starts out empty and the file is
+// created on the first Put().
+func NewFileCredentialStore(path string, secret []byte) (*FileCredentialStore, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("credential store secret must not be empty")
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileCredentialStore{
+		path:  path,
+		aead:  aead,
+		creds: map[string]Credentials{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newAEAD(secret []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating GCM: %v", err)
+	}
+	return aead, nil
+}
+
+func encrypt(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %v", err)
+	}
+	return plaintext, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// as path, and renames it into place so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *FileCredentialStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading credential store: %v", err)
+	}
+	plaintext, err := decrypt(s.aead, data)
+	if err != nil {
+		return fmt.Errorf("reading credential store %s: %v", s.path, err)
+	}
+	if err := json.Unmarshal(plaintext, &s.creds); err != nil {
+		return fmt.Errorf("cannot decode credential store JSON: %v", err)
+	}
+	return nil
+}
+
+// save must be called with the lock held.
+func (s *FileCredentialStore) save() error {
+	plaintext, err := json.Marshal(s.creds)
+	if err != nil {
+		return err
+	}
+	data, err := encrypt(s.aead, plaintext)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("writing credential store: %v", err)
+	}
+	return nil
+}
+
+// Get implements CredentialStore.
+func (s *FileCredentialStore) Get(key string) (Credentials, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	c, found := s.creds[key]
+	return c, found, nil
+}
+
+// Put implements CredentialStore.
+func (s *FileCredentialStore) Put(key string, creds Credentials) error {
+	s.Lock()
+	defer s.Unlock()
+	if existing, found := s.creds[key]; found && existing.URL == creds.URL &&
+		existing.Token == creds.Token && existing.Credential.equal(creds.Credential) &&
+		existing.FetchedAt.Equal(creds.FetchedAt) {
+		return nil
+	}
+	s.creds[key] = creds
+	return s.save()
+}
+
+// Delete implements CredentialStore.
+func (s *FileCredentialStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.creds[key]; !found {
+		return nil
+	}
+	delete(s.creds, key)
+	return s.save()
+}
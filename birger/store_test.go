@@ -0,0 +1,83 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileCredentialStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds")
+	secret := []byte("sekret")
+
+	s, err := NewFileCredentialStore(path, secret)
+	require.NoError(t, err)
+	_, found, err := s.Get("smith:whoami:whoami")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	want := Credentials{URL: "https://whoami.example.com", Token: "abc"}
+	require.NoError(t, s.Put("smith:whoami:whoami", want))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "whoami.example.com")
+
+	t.Run("reloads from disk", func(t *testing.T) {
+		s2, err := NewFileCredentialStore(path, secret)
+		require.NoError(t, err)
+		got, found, err := s2.Get("smith:whoami:whoami")
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, want, got)
+	})
+
+	t.Run("wrong secret fails", func(t *testing.T) {
+		_, err := NewFileCredentialStore(path, []byte("wrong"))
+		require.Error(t, err)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, s.Delete("smith:whoami:whoami"))
+		require.NoError(t, s.Delete("not:there:atall"))
+		s2, err := NewFileCredentialStore(path, secret)
+		require.NoError(t, err)
+		_, found, err := s2.Get("smith:whoami:whoami")
+		require.NoError(t, err)
+		require.False(t, found)
+	})
+}
+
+func TestControllerManager_usesCredentialStore(t *testing.T) {
+	c := newTestController(t)
+	store := NewMemoryCredentialStore()
+	require.NoError(t, store.Put("smith:whoami:whoami", Credentials{URL: "https://stored.example.com", Token: "stored"}))
+
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL, Token: "abc"}, []string{"whoami"}, WithCredentialStore(store))
+
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	update := <-m.UpdateChan
+	require.Equal(t, "https://stored.example.com", update.URL)
+	require.Equal(t, "stored", update.Token)
+	require.Equal(t, int32(0), atomic.LoadInt32(&c.credentialRequests))
+}
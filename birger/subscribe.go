@@ -0,0 +1,311 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"sync"
+)
+
+// OverflowPolicy controls what happens when an update is published to
+// a subscription whose buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the ControllerManager wait until the subscriber
+	// has room.  Nothing is lost, but a slow subscriber delays everyone.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest buffered update to make room.
+	OverflowDropOldest
+	// OverflowCoalesce replaces a buffered update for the same service with
+	// the newer one, so the subscriber only sees the latest state.  If there
+	// is no update for the same service buffered, it behaves like OverflowBlock.
+	OverflowCoalesce
+)
+
+// SubscriptionFilter returns true for the updates a subscriber wants to
+// receive.  A nil filter receives every update.
+type SubscriptionFilter func(ServiceUpdate) bool
+
+// SubscribeOptions configures a single subscription.
+type SubscribeOptions struct {
+	BufferSize int // default 10
+	Overflow   OverflowPolicy
+}
+
+const defaultSubscriptionBufferSize = 10
+
+// Subscription receives ServiceUpdates from a ControllerManager
+// independently of any other subscriber.
+type Subscription struct {
+	// C receives updates for channel subscriptions, and is closed when
+	// the subscription ends.  It is nil for callback subscriptions.
+	C <-chan ServiceUpdate
+
+	b      *broadcaster
+	filter SubscriptionFilter
+	policy OverflowPolicy
+	size   int
+	out    chan ServiceUpdate
+	fn     func(ServiceUpdate)
+	done   chan struct{}
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  []ServiceUpdate
+	closed bool
+}
+
+// broadcaster delivers updates to subscriptions.  Each kind of manager
+// embeds one.
+type broadcaster struct {
+	subscriptionLock    sync.Mutex
+	subscriptions       []*Subscription
+	subscriptionsClosed bool
+
+	// metrics may be nil when a manager is made without its constructor
+	// in tests.
+	metrics   Metrics
+	queueLock sync.Mutex
+	queued    int
+}
+
+// Subscribe returns a new Subscription which receives updates matching
+// filter on its channel C.
+//
+// Updates already sent before Subscribe is called are not replayed.
+// When the manager shuts down or Unsubscribe() is called, any updates
+// still buffered are discarded and C is closed.
+func (m *ControllerManager) Subscribe(filter SubscriptionFilter, opts SubscribeOptions) *Subscription {
+	return m.subscribe(filter, opts)
+}
+
+// SubscribeFunc is like Subscribe, but calls fn for each update instead of
+// sending it on a channel.  fn is called from a single goroutine owned by
+// the subscription, so calls are never concurrent with each other.
+func (m *ControllerManager) SubscribeFunc(filter SubscriptionFilter, opts SubscribeOptions, fn func(ServiceUpdate)) *Subscription {
+	return m.subscribeFunc(filter, opts, fn)
+}
+
+func (b *broadcaster) subscribe(filter SubscriptionFilter, opts SubscribeOptions) *Subscription {
+	out := make(chan ServiceUpdate)
+	s := b.newSubscription(filter, opts)
+	s.out = out
+	s.C = out
+	b.addSubscription(s)
+	return s
+}
+
+func (b *broadcaster) subscribeFunc(filter SubscriptionFilter, opts SubscribeOptions, fn func(ServiceUpdate)) *Subscription {
+	s := b.newSubscription(filter, opts)
+	s.fn = fn
+	b.addSubscription(s)
+	return s
+}
+
+func (b *broadcaster) newSubscription(filter SubscriptionFilter, opts SubscribeOptions) *Subscription {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultSubscriptionBufferSize
+	}
+	s := &Subscription{
+		b:      b,
+		filter: filter,
+		policy: opts.Overflow,
+		size:   opts.BufferSize,
+		done:   make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+func (b *broadcaster) addSubscription(s *Subscription) {
+	b.subscriptionLock.Lock()
+	defer b.subscriptionLock.Unlock()
+	go s.pump()
+	if b.subscriptionsClosed {
+		s.close()
+		return
+	}
+	b.subscriptions = append(b.subscriptions, s)
+}
+
+// Unsubscribe stops delivery of updates.  It is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.b.removeSubscription(s)
+	s.close()
+}
+
+func (b *broadcaster) removeSubscription(s *Subscription) {
+	b.subscriptionLock.Lock()
+	defer b.subscriptionLock.Unlock()
+	for i, sub := range b.subscriptions {
+		if sub == s {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// closeSubscriptions ends every subscription, and any made later.
+func (b *broadcaster) closeSubscriptions() {
+	b.subscriptionLock.Lock()
+	subs := b.subscriptions
+	b.subscriptions = nil
+	b.subscriptionsClosed = true
+	b.subscriptionLock.Unlock()
+	for _, s := range subs {
+		s.close()
+	}
+}
+
+// publish hands the update to every matching subscription.
+func (b *broadcaster) publish(u ServiceUpdate) {
+	b.subscriptionLock.Lock()
+	subs := make([]*Subscription, len(b.subscriptions))
+	copy(subs, b.subscriptions)
+	b.subscriptionLock.Unlock()
+	for _, s := range subs {
+		s.publish(u)
+	}
+}
+
+// queueChanged adjusts the number of updates buffered across all
+// subscriptions.
+func (b *broadcaster) queueChanged(delta int) {
+	b.queueLock.Lock()
+	defer b.queueLock.Unlock()
+	b.queued += delta
+	if b.metrics != nil {
+		b.metrics.SetUpdateQueueDepth(b.queued)
+	}
+}
+
+func (s *Subscription) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.cond.Broadcast()
+}
+
+// publish queues the update according to the overflow policy.  With
+// OverflowBlock or OverflowCoalesce, it waits for room or for the
+// subscription to be closed.
+func (s *Subscription) publish(u ServiceUpdate) {
+	if s.filter != nil && !s.filter(u) {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.policy == OverflowCoalesce && s.coalesce(u) {
+		return
+	}
+	for len(s.queue) >= s.size && !s.closed {
+		if s.policy == OverflowDropOldest {
+			s.queue = s.queue[1:]
+			s.b.queueChanged(-1)
+			break
+		}
+		s.cond.Wait()
+	}
+	if s.closed {
+		return
+	}
+	s.queue = append(s.queue, u)
+	s.b.queueChanged(1)
+	s.cond.Broadcast()
+}
+
+// coalesce merges u into an update already queued for the same service,
+// returning true if it did.  Must be called with the lock held.
+func (s *Subscription) coalesce(u ServiceUpdate) bool {
+	key := u.key()
+	for i, queued := range s.queue {
+		if queued.key() != key {
+			continue
+		}
+		if merged, keep := coalesceUpdates(queued, u); keep {
+			s.queue[i] = merged
+		} else {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.b.queueChanged(-1)
+			s.cond.Broadcast()
+		}
+		return true
+	}
+	return false
+}
+
+// coalesceUpdates returns the single update which has the same effect as
+// queued followed by u, for the same service.  The boolean is false if
+// neither needs to be sent.
+func coalesceUpdates(queued ServiceUpdate, u ServiceUpdate) (ServiceUpdate, bool) {
+	switch {
+	case queued.Operation == OperationAdd && u.Operation == OperationDelete:
+		// the subscriber never saw the add, so it need not see either.
+		return ServiceUpdate{}, false
+	case queued.Operation == OperationAdd:
+		u.Operation = OperationAdd
+	case queued.Operation == OperationDelete && u.Operation == OperationAdd:
+		// the subscriber still has the service from before the delete.
+		u.Operation = OperationUpdate
+	}
+	return u, true
+}
+
+// pump delivers queued updates to the subscriber until the subscription
+// is closed.
+func (s *Subscription) pump() {
+	if s.out != nil {
+		defer close(s.out)
+	}
+	for {
+		s.lock.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.b.queueChanged(-len(s.queue))
+			s.queue = nil
+			s.lock.Unlock()
+			return
+		}
+		u := s.queue[0]
+		s.queue = s.queue[1:]
+		s.b.queueChanged(-1)
+		s.cond.Broadcast()
+		s.lock.Unlock()
+
+		if s.fn != nil {
+			s.fn(u)
+			continue
+		}
+		select {
+		case s.out <- u:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Pending returns the number of updates buffered and not yet delivered.
+func (s *Subscription) Pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.queue)
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func drain(t *testing.T, s *Subscription) []ServiceUpdate {
+	t.Helper()
+	ret := []ServiceUpdate{}
+	for {
+		select {
+		case u, ok := <-s.C:
+			if !ok {
+				return ret
+			}
+			ret = append(ret, u)
+		case <-time.After(100 * time.Millisecond):
+			return ret
+		}
+	}
+}
+
+func TestSubscription_filter(t *testing.T) {
+	m := &ControllerManager{}
+	s := m.Subscribe(func(u ServiceUpdate) bool { return u.Type == "argocd" }, SubscribeOptions{})
+	defer s.Unsubscribe()
+
+	m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: "a", Type: "whoami"})
+	m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: "b", Type: "argocd"})
+
+	got := drain(t, s)
+	require.Len(t, got, 1)
+	require.Equal(t, "b", got[0].Name)
+}
+
+func TestSubscription_block(t *testing.T) {
+	m := &ControllerManager{}
+	s := m.Subscribe(nil, SubscribeOptions{BufferSize: 1})
+	defer s.Unsubscribe()
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: fmt.Sprintf("svc%d", i)})
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		u := <-s.C
+		require.Equal(t, fmt.Sprintf("svc%d", i), u.Name)
+	}
+}
+
+func TestSubscription_dropOldest(t *testing.T) {
+	m := &ControllerManager{}
+	s := m.Subscribe(nil, SubscribeOptions{BufferSize: 2, Overflow: OverflowDropOldest})
+	defer s.Unsubscribe()
+
+	for i := 0; i < 5; i++ {
+		m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: fmt.Sprintf("svc%d", i)})
+	}
+
+	// One update may already be waiting in the channel, the rest are
+	// the newest which fit in the buffer.
+	got := drain(t, s)
+	require.LessOrEqual(t, len(got), 3)
+	require.Equal(t, "svc3", got[len(got)-2].Name)
+	require.Equal(t, "svc4", got[len(got)-1].Name)
+}
+
+func TestSubscription_coalesce(t *testing.T) {
+	m := &ControllerManager{}
+	s := m.Subscribe(nil, SubscribeOptions{Overflow: OverflowCoalesce})
+	defer s.Unsubscribe()
+
+	// once the pump is holding the first update, the rest stay queued.
+	m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: "first"})
+	require.Eventually(t, func() bool { return s.Pending() == 0 }, time.Second, time.Millisecond)
+
+	m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: "a"})
+	m.publish(ServiceUpdate{Operation: OperationUpdate, AgentName: "smith", Name: "a", Token: "one"})
+	m.publish(ServiceUpdate{Operation: OperationUpdate, AgentName: "smith", Name: "a", Token: "two"})
+	m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: "b"})
+	m.publish(ServiceUpdate{Operation: OperationDelete, AgentName: "smith", Name: "b"})
+	require.Equal(t, 1, s.Pending())
+
+	got := drain(t, s)
+	require.Len(t, got, 2)
+	require.Equal(t, "first", got[0].Name)
+	require.Equal(t, OperationAdd, got[1].Operation)
+	require.Equal(t, "a", got[1].Name)
+	require.Equal(t, "two", got[1].Token)
+}
+
+func TestSubscription_func(t *testing.T) {
+	m := &ControllerManager{}
+	got := make(chan ServiceUpdate, 1)
+	s := m.SubscribeFunc(nil, SubscribeOptions{}, func(u ServiceUpdate) { got <- u })
+	defer s.Unsubscribe()
+	require.Nil(t, s.C)
+
+	m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: "a"})
+	require.Equal(t, "a", (<-got).Name)
+}
+
+func TestSubscription_Unsubscribe(t *testing.T) {
+	m := &ControllerManager{}
+	s := m.Subscribe(nil, SubscribeOptions{})
+	s.Unsubscribe()
+	s.Unsubscribe()
+
+	m.publish(ServiceUpdate{Operation: OperationAdd, AgentName: "smith", Name: "a"})
+	_, ok := <-s.C
+	require.False(t, ok)
+
+	m.closeSubscriptions()
+	s = m.Subscribe(nil, SubscribeOptions{})
+	_, ok = <-s.C
+	require.False(t, ok)
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"fmt"
+)
+
+// Sync syncs with the controller right away and returns the changes made.
+// Updates are delivered to subscribers as for any other sync, so Sync
+// blocks while a subscription with OverflowBlock is full.  If a sync is
+// already running, Sync waits for it to finish and then does another.
+//
+// The error is from polling the controller, or from the last service
+// whose credentials could not be fetched; the Diff still holds the changes
+// made for the other services.  Sync does not move the next scheduled sync.
+func (m *ControllerManager) Sync(ctx context.Context) (Diff, error) {
+	if m.ctx.Err() != nil {
+		return Diff{}, fmt.Errorf("controller manager is shut down")
+	}
+	// stop when either the caller gives up or the manager shuts down.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+	diff, _, err := m.reloadFromController(ctx)
+	return diff, err
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/utkarsh-opsmx/go-app-base/httputil"
+)
+
+// buildTLSConfig returns the TLS configuration used to talk to the
+// controller, loading any certificate files named in the config.
+func (cc *Config) buildTLSConfig() (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if cc.TLSConfig != nil {
+		tlsConfig = cc.TLSConfig.Clone()
+	} else if tlsConfig = httputil.DefaultTLSConfig(); tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+		}
+	}
+
+	if cc.CACertFile != "" {
+		pem, err := os.ReadFile(cc.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates: %v", err)
+		}
+		// add to the base config's roots, if it has its own.
+		var pool *x509.CertPool
+		if tlsConfig.RootCAs != nil {
+			pool = tlsConfig.RootCAs.Clone()
+		} else if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cc.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cc.ClientCertFile != "" || cc.ClientKeyFile != "" {
+		if cc.ClientCertFile == "" || cc.ClientKeyFile == "" {
+			return nil, fmt.Errorf("both clientCertFile and clientKeyFile must be set")
+		}
+		cert, err := tls.LoadX509KeyPair(cc.ClientCertFile, cc.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cc.ServerName != "" {
+		tlsConfig.ServerName = cc.ServerName
+	}
+
+	return tlsConfig, nil
+}
+
+// tlsFileTimes returns the modification time of each certificate file
+// named in the config.  Files which cannot be read have a zero time,
+// so they count as changed once they appear.
+func (cc *Config) tlsFileTimes() map[string]time.Time {
+	ret := map[string]time.Time{}
+	for _, path := range []string{cc.CACertFile, cc.ClientCertFile, cc.ClientKeyFile} {
+		if path == "" {
+			continue
+		}
+		var mtime time.Time
+		if st, err := os.Stat(path); err == nil {
+			mtime = st.ModTime()
+		}
+		ret[path] = mtime
+	}
+	return ret
+}
+
+func tlsFilesChanged(a map[string]time.Time, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for k, v := range a {
+		if !v.Equal(b[k]) {
+			return true
+		}
+	}
+	return false
+}
+
+// getHTTPClient returns the client used to talk to the controller.  If one
+// was provided with WithHTTPClient(), it is always used.  Otherwise, one is
+// made with httputil.NewHTTPClient(), and if any of the certificate files
+// have changed on disk since then, a new one is made with the new
+// certificates.  If that fails, the error is logged and the previous client
+// continues to be used until the files change again.
+func (m *ControllerManager) getHTTPClient() (*http.Client, error) {
+	if m.httpClient != nil {
+		return m.httpClient, nil
+	}
+
+	m.tlsClientLock.Lock()
+	defer m.tlsClientLock.Unlock()
+
+	fileTimes := m.conf.tlsFileTimes()
+	if m.tlsClient != nil && !tlsFilesChanged(m.tlsFiles, fileTimes) {
+		return m.tlsClient, nil
+	}
+
+	tlsConfig, err := m.conf.buildTLSConfig()
+	if err != nil {
+		if m.tlsClient != nil {
+			log.Printf("unable to reload controller TLS certificates, using the previous ones: %v", err)
+			m.tlsFiles = fileTimes
+			return m.tlsClient, nil
+		}
+		return nil, err
+	}
+
+	if m.tlsClient != nil {
+		m.tlsClient.CloseIdleConnections()
+	}
+	m.tlsClient = httputil.NewHTTPClient(httputil.WithTLS(tlsConfig))
+	m.tlsFiles = fileTimes
+
+	return m.tlsClient, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/utkarsh-opsmx/go-app-base/httputil"
+)
+
+func TestControllerManager_getHTTPClient(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+
+	m := &ControllerManager{conf: Config{CACertFile: caFile, ServerName: "example.com"}}
+	_, err := m.getHTTPClient()
+	require.Error(t, err)
+
+	t.Run("picks up a changed CA file", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(caFile, caPEM, 0600))
+		later := time.Now().Add(time.Second)
+		require.NoError(t, os.Chtimes(caFile, later, later))
+
+		client, err := m.getHTTPClient()
+		require.NoError(t, err)
+		resp, err := client.Get(s.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		again, err := m.getHTTPClient()
+		require.NoError(t, err)
+		require.Same(t, client, again)
+	})
+
+	t.Run("keeps the old client if the new files are bad", func(t *testing.T) {
+		client, err := m.getHTTPClient()
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0600))
+		later := time.Now().Add(2 * time.Second)
+		require.NoError(t, os.Chtimes(caFile, later, later))
+
+		again, err := m.getHTTPClient()
+		require.NoError(t, err)
+		require.Same(t, client, again)
+
+		// the bad files are not loaded again until they change.
+		require.Equal(t, m.conf.tlsFileTimes(), m.tlsFiles)
+	})
+}
+
+func TestConfig_buildTLSConfig(t *testing.T) {
+	t.Run("cert requires key", func(t *testing.T) {
+		c := Config{ClientCertFile: "cert.pem"}
+		_, err := c.buildTLSConfig()
+		require.Error(t, err)
+	})
+
+	t.Run("CA file adds to base roots", func(t *testing.T) {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer s.Close()
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(t, os.WriteFile(caFile, selfSignedPEM(t), 0600))
+
+		// the server is trusted only through the base config.
+		base := x509.NewCertPool()
+		base.AddCert(s.Certificate())
+		c := Config{CACertFile: caFile, TLSConfig: &tls.Config{RootCAs: base}}
+		tlsConfig, err := c.buildTLSConfig()
+		require.NoError(t, err)
+		require.Len(t, tlsConfig.RootCAs.Subjects(), 2)
+		require.Len(t, base.Subjects(), 1)
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(s.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+	})
+
+	t.Run("app-wide config is the default base", func(t *testing.T) {
+		saved := httputil.DefaultTLSConfig()
+		t.Cleanup(func() { httputil.SetTLSConfig(saved) })
+		roots := x509.NewCertPool()
+		httputil.SetTLSConfig(&tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+
+		c := Config{}
+		tlsConfig, err := c.buildTLSConfig()
+		require.NoError(t, err)
+		require.Same(t, roots, tlsConfig.RootCAs)
+		require.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+
+		c = Config{TLSConfig: &tls.Config{}}
+		tlsConfig, err = c.buildTLSConfig()
+		require.NoError(t, err)
+		require.Nil(t, tlsConfig.RootCAs)
+	})
+
+	t.Run("server name", func(t *testing.T) {
+		c := Config{ServerName: "controller.internal"}
+		tlsConfig, err := c.buildTLSConfig()
+		require.NoError(t, err)
+		require.Equal(t, "controller.internal", tlsConfig.ServerName)
+	})
+}
+
+func TestControllerManager_getHTTPClient_injected(t *testing.T) {
+	client := &http.Client{}
+	m := &ControllerManager{conf: Config{ClientCertFile: "missing.pem"}}
+	WithHTTPClient(client)(m)
+
+	got, err := m.getHTTPClient()
+	require.NoError(t, err)
+	require.Same(t, client, got)
+}
+
+// selfSignedPEM returns a new self-signed CA certificate.
+func selfSignedPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
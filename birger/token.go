@@ -0,0 +1,205 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource supplies the token used to authenticate to the controller.
+// Implementations must be safe for concurrent use.
+type TokenSource interface {
+	// Token returns the current token.
+	Token(ctx context.Context) (string, error)
+	// Refresh is called when the controller rejects the current token.
+	// It returns a new token, which is the same as the old one if
+	// nothing has changed.
+	Refresh(ctx context.Context) (string, error)
+}
+
+// StaticTokenSource returns a TokenSource which always returns token.
+func StaticTokenSource(token string) TokenSource {
+	return staticTokenSource(token)
+}
+
+type staticTokenSource string
+
+func (s staticTokenSource) Token(_ context.Context) (string, error) {
+	return string(s), nil
+}
+
+func (s staticTokenSource) Refresh(ctx context.Context) (string, error) {
+	return s.Token(ctx)
+}
+
+// EnvTokenSource returns a TokenSource which reads the token from the
+// named envar each time it is needed.
+func EnvTokenSource(name string) TokenSource {
+	return envTokenSource(name)
+}
+
+type envTokenSource string
+
+func (s envTokenSource) Token(_ context.Context) (string, error) {
+	t := os.Getenv(string(s))
+	if t == "" {
+		return "", fmt.Errorf("envar %s is not set", string(s))
+	}
+	return t, nil
+}
+
+func (s envTokenSource) Refresh(ctx context.Context) (string, error) {
+	return s.Token(ctx)
+}
+
+// FileTokenSource reads the token from a file, such as a projected service
+// account token, and reads it again whenever the file changes.  Leading and
+// trailing whitespace is removed.
+type FileTokenSource struct {
+	sync.Mutex
+	path  string
+	mtime time.Time
+	token string
+}
+
+var _ TokenSource = &FileTokenSource{}
+
+// NewFileTokenSource returns a FileTokenSource which reads path.
+func NewFileTokenSource(path string) *FileTokenSource {
+	return &FileTokenSource{path: path}
+}
+
+// Token implements TokenSource.
+func (s *FileTokenSource) Token(_ context.Context) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	st, err := os.Stat(s.path)
+	if err != nil {
+		return "", fmt.Errorf("reading token file: %v", err)
+	}
+	if s.token != "" && st.ModTime().Equal(s.mtime) {
+		return s.token, nil
+	}
+	return s.read(st.ModTime())
+}
+
+// Refresh implements TokenSource.  The file is always read again.
+func (s *FileTokenSource) Refresh(_ context.Context) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	st, err := os.Stat(s.path)
+	if err != nil {
+		return "", fmt.Errorf("reading token file: %v", err)
+	}
+	return s.read(st.ModTime())
+}
+
+// read must be called with the lock held.
+func (s *FileTokenSource) read(mtime time.Time) (string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("reading token file: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", s.path)
+	}
+	s.token = token
+	s.mtime = mtime
+	return token, nil
+}
+
+// ExecTokenSource runs an external command to get the token, and uses its
+// trimmed standard output.  The token is cached for the configured time,
+// and the command is run again when the cache expires or the controller
+// rejects the token.
+type ExecTokenSource struct {
+	sync.Mutex
+	command   []string
+	cacheTime time.Duration
+	token     string
+	fetchedAt time.Time
+}
+
+var _ TokenSource = &ExecTokenSource{}
+
+const defaultExecTokenCacheTime = 5 * time.Minute
+
+// NewExecTokenSource returns an ExecTokenSource which runs command, which
+// is the program followed by its arguments.  If cacheTime is 0, a
+// default of 5 minutes is used.
+func NewExecTokenSource(command []string, cacheTime time.Duration) *ExecTokenSource {
+	if cacheTime == 0 {
+		cacheTime = defaultExecTokenCacheTime
+	}
+	return &ExecTokenSource{command: command, cacheTime: cacheTime}
+}
+
+// Token implements TokenSource.
+func (s *ExecTokenSource) Token(ctx context.Context) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.token != "" && time.Since(s.fetchedAt) < s.cacheTime {
+		return s.token, nil
+	}
+	return s.run(ctx)
+}
+
+// Refresh implements TokenSource.  The command is always run again.
+func (s *ExecTokenSource) Refresh(ctx context.Context) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.run(ctx)
+}
+
+// run must be called with the lock held.
+func (s *ExecTokenSource) run(ctx context.Context) (string, error) {
+	if len(s.command) == 0 {
+		return "", fmt.Errorf("no token command configured")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running token command: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", fmt.Errorf("token command returned no token")
+	}
+	s.token = token
+	s.fetchedAt = time.Now()
+	return token, nil
+}
+
+// tokenSource returns the TokenSource described by the config.
+func (cc *Config) tokenSource() TokenSource {
+	switch {
+	case cc.Token != "":
+		return StaticTokenSource(cc.Token)
+	case cc.TokenFile != "":
+		return NewFileTokenSource(cc.TokenFile)
+	default:
+		return NewExecTokenSource(cc.TokenCommand, time.Duration(cc.TokenCommandCacheSeconds)*time.Second)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTokenSource(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0600))
+
+	s := NewFileTokenSource(path)
+	token, err := s.Token(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "first", token)
+
+	require.NoError(t, os.WriteFile(path, []byte("second\n"), 0600))
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	token, err = s.Token(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "second", token)
+
+	require.NoError(t, os.WriteFile(path, []byte("  \n"), 0600))
+	_, err = s.Refresh(ctx)
+	require.Error(t, err)
+}
+
+func TestEnvTokenSource(t *testing.T) {
+	t.Setenv("TEST_BIRGER_TOKEN", "abc")
+	token, err := EnvTokenSource("TEST_BIRGER_TOKEN").Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "abc", token)
+
+	t.Setenv("TEST_BIRGER_TOKEN", "")
+	_, err = EnvTokenSource("TEST_BIRGER_TOKEN").Token(context.Background())
+	require.Error(t, err)
+}
+
+func TestExecTokenSource(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "count")
+	// each run appends a line, and prints the number of runs so far.
+	s := NewExecTokenSource([]string{"sh", "-c", "echo >> " + counter + "; wc -l < " + counter}, time.Hour)
+
+	token, err := s.Token(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "1", token)
+
+	token, err = s.Token(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "1", token, "cached token is used")
+
+	token, err = s.Refresh(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "2", token)
+
+	t.Run("failing command", func(t *testing.T) {
+		_, err := NewExecTokenSource([]string{"sh", "-c", "exit 1"}, 0).Token(ctx)
+		require.Error(t, err)
+	})
+}
+
+type rotatingTokenSource struct{}
+
+func (rotatingTokenSource) Token(_ context.Context) (string, error)   { return "old", nil }
+func (rotatingTokenSource) Refresh(_ context.Context) (string, error) { return "new", nil }
+
+func TestControllerManager_retriesWithRefreshedToken(t *testing.T) {
+	c := newTestController(t)
+	c.setRequiredToken("new")
+
+	m, err := NewControllerManager(context.Background(), Config{URL: c.URL}, []string{"whoami"}, WithTokenSource(rotatingTokenSource{}))
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	select {
+	case update := <-m.UpdateChan:
+		require.Equal(t, "whoami", update.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update with refreshed token")
+	}
+}
@@ -14,18 +14,45 @@
 
 package birger
 
+// Operation describes what happened to a service in a ServiceUpdate.
+type Operation string
+
+const (
+	// OperationAdd is sent the first time a service is seen.
+	OperationAdd Operation = "add"
+	// OperationUpdate is sent when a known service's annotations or
+	// credentials change.
+	OperationUpdate Operation = "update"
+	// OperationDelete is sent when a service is no longer present in
+	// the controller.
+	OperationDelete Operation = "delete"
+	// OperationStale is sent when a service's agent has stopped pinging
+	// the controller.  Once it pings again, an OperationUpdate is sent
+	// with Stale set to false.
+	OperationStale Operation = "stale"
+)
+
 // ServiceUpdate contains an update message sent when a new service type is
-// discovered or is no longer present in the controller.
+// discovered, changes, or is no longer present in the controller.
 //
-// Operation is either 'update' or 'delete'.  For both,
-// Name, Type, and AgentName will be set.  For update only, the
-// URL and Token will also be included.
+// For all operations, Name, Type, and AgentName will be set.  For
+// add, update, and stale, the Annotations, URL, Token, Agent, and Stale
+// will also be included.  Annotations are the endpoint's; the agent's own annotations
+// are in Agent.
 type ServiceUpdate struct {
-	Operation   string // delete, update (implies add)
+	Operation   Operation
 	Name        string
 	Type        string
 	AgentName   string
-	Annotations map[string]string // Only set for update
-	Token       string            // Only set for update
-	URL         string            // Only set for update
+	Annotations map[string]string // Not set for delete
+	Token       string            // Not set for delete; the bearer token, if Credential has one
+	Credential  ServiceCredential // Not set for delete
+	URL         string            // Not set for delete
+	Agent       AgentInfo         // Not set for delete
+	Stale       bool              // True if the agent has not pinged recently
+	Controller  string            // the controller's name, set only by a FederatedManager
+}
+
+func (u ServiceUpdate) key() string {
+	return serviceKey(u.AgentName, u.Name, u.Type)
 }
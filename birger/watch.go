@@ -0,0 +1,133 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/utkarsh-opsmx/go-app-base/sse"
+)
+
+// The controller sends an event on this stream whenever an agent connects
+// or disconnects, or an agent's endpoints change.  The event content is
+// not used; any event causes a sync.
+const streamAgentEventsPath = "/api/v1/streamAgentEvents"
+
+// A stream which stays up at least this long resets the reconnect backoff.
+const watchStableTime = time.Minute
+
+func (m *ControllerManager) setStreaming(streaming bool) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.streaming = streaming
+}
+
+func (m *ControllerManager) isStreaming() bool {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	return m.streaming
+}
+
+// pollInterval returns how long to wait between polls when all is well.
+func (m *ControllerManager) pollInterval() time.Duration {
+	if m.isStreaming() {
+		return m.watchResyncRate
+	}
+	return m.updateRate
+}
+
+// watcher keeps the event stream connected until the manager shuts down.
+func (m *ControllerManager) watcher() {
+	defer m.shutdownCount.Done()
+
+	b := backoff{min: m.pollBackoff.min, max: m.pollBackoff.max}
+	for {
+		started := m.clock.Now()
+		err := m.watch(m.ctx)
+		if m.isStreaming() {
+			m.setStreaming(false)
+			// fall back to polling at the normal rate right away.
+			m.triggerSync()
+		}
+		if m.ctx.Err() != nil {
+			return
+		}
+		if m.since(started) >= watchStableTime {
+			b.reset()
+		}
+		delay := b.next()
+		log.Printf("controller event stream: %v, reconnecting in %s", err, delay)
+
+		t := m.clock.NewTimer(delay)
+		select {
+		case <-m.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+	}
+}
+
+// watch connects to the event stream and triggers a sync for each event
+// received.  It returns when the stream ends.
+func (m *ControllerManager) watch(ctx context.Context) error {
+	api, err := m.getAPI(ctx)
+	if err != nil {
+		return err
+	}
+	url, err := url.JoinPath(m.conf.URL, api.eventsPath())
+	if err != nil {
+		return fmt.Errorf("joining url: %v", err)
+	}
+
+	client, err := m.getHTTPClient()
+	if err != nil {
+		return fmt.Errorf("making TLS client: %v", err)
+	}
+	// The stream is expected to stay open, so the overall client timeout
+	// must not apply.
+	streamClient := *client
+	streamClient.Timeout = 0
+
+	resp, err := m.doRequest(ctx, &streamClient, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("connecting: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("connecting: http status %d", resp.StatusCode)
+	}
+
+	m.setStreaming(true)
+	// anything could have changed while we were not connected.
+	m.triggerSync()
+
+	events := sse.NewSSE(resp.Body)
+	for {
+		event, eof := events.Read()
+		if eof {
+			return fmt.Errorf("stream closed")
+		}
+		if len(event) == 0 {
+			continue
+		}
+		m.triggerSync()
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestControllerManager_watch(t *testing.T) {
+	c := newTestController(t)
+	conf := Config{URL: c.URL, Token: "abc", Watch: true, UpdateFrequencySeconds: 3600}
+	m, err := NewControllerManager(context.Background(), conf, []string{"whoami"})
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	update := <-m.UpdateChan
+	require.Equal(t, "whoami", update.Name)
+	require.Eventually(t, m.isStreaming, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, time.Duration(defaultConfig.WatchResyncSeconds)*time.Second, m.pollInterval())
+
+	c.setStatistics(agentStatisticsWith("whoami", "another"))
+	c.events <- "endpointsChanged"
+
+	select {
+	case update = <-m.UpdateChan:
+		require.Equal(t, OperationAdd, update.Operation)
+		require.Equal(t, "another", update.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event did not cause a sync")
+	}
+}
+
+func TestControllerManager_watchIgnoresComments(t *testing.T) {
+	c := newTestController(t)
+	conf := Config{URL: c.URL, Token: "abc", Watch: true, UpdateFrequencySeconds: 3600}
+	m, err := NewControllerManager(context.Background(), conf, []string{"whoami"})
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	<-m.UpdateChan
+	require.Eventually(t, m.isStreaming, 5*time.Second, 10*time.Millisecond)
+	// wait for the sync made on connecting.
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&c.statisticsRequests) >= 2 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	before := atomic.LoadInt32(&c.statisticsRequests)
+
+	for i := 0; i < 5; i++ {
+		c.rawEvents <- ": ping\n\n"
+	}
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, before, atomic.LoadInt32(&c.statisticsRequests))
+	require.True(t, m.isStreaming())
+}
+
+func TestControllerManager_watchFieldWithoutColon(t *testing.T) {
+	c := newTestController(t)
+	conf := Config{URL: c.URL, Token: "abc", Watch: true, UpdateFrequencySeconds: 3600}
+	m, err := NewControllerManager(context.Background(), conf, []string{"whoami"})
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	<-m.UpdateChan
+	require.Eventually(t, m.isStreaming, 5*time.Second, 10*time.Millisecond)
+
+	// a field with no colon is valid, and is still an event.
+	c.setStatistics(agentStatisticsWith("whoami", "another"))
+	c.rawEvents <- "data\n\n"
+
+	select {
+	case update := <-m.UpdateChan:
+		require.Equal(t, OperationAdd, update.Operation)
+		require.Equal(t, "another", update.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event did not cause a sync")
+	}
+}
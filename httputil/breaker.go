@@ -0,0 +1,279 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerConfig configures a CircuitBreaker.  Zero values are replaced by
+// defaults.
+type BreakerConfig struct {
+	// FailureThreshold is how many requests to a host must fail in a row
+	// to open its circuit.
+	FailureThreshold int `json:"failureThreshold,omitempty" yaml:"failureThreshold,omitempty"`
+	// CoolDownSeconds is how long a circuit stays open before trial
+	// requests are let through.
+	CoolDownSeconds int `json:"coolDownSeconds,omitempty" yaml:"coolDownSeconds,omitempty"`
+	// HalfOpenRequests is how many trial requests may be in flight at once.
+	HalfOpenRequests int `json:"halfOpenRequests,omitempty" yaml:"halfOpenRequests,omitempty"`
+	// FailureStatusCodes are the response codes which count as failures,
+	// as well as errors making the request.
+	FailureStatusCodes []int `json:"failureStatusCodes,omitempty" yaml:"failureStatusCodes,omitempty"`
+
+	// OnStateChange, if set, is called when a host's circuit changes state.
+	// It must not block.
+	OnStateChange func(host string, from BreakerState, to BreakerState) `json:"-" yaml:"-"`
+}
+
+var defaultBreakerConfig = BreakerConfig{
+	FailureThreshold:   5,
+	CoolDownSeconds:    30,
+	HalfOpenRequests:   1,
+	FailureStatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+}
+
+func (c *BreakerConfig) applyDefaults() {
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = defaultBreakerConfig.FailureThreshold
+	}
+	if c.CoolDownSeconds == 0 {
+		c.CoolDownSeconds = defaultBreakerConfig.CoolDownSeconds
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = defaultBreakerConfig.HalfOpenRequests
+	}
+	if len(c.FailureStatusCodes) == 0 {
+		c.FailureStatusCodes = append([]int{}, defaultBreakerConfig.FailureStatusCodes...)
+	}
+}
+
+// BreakerState is the state of a host's circuit.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all requests without sending them.
+	BreakerOpen
+	// BreakerHalfOpen lets a few trial requests through, to see if the
+	// host has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// CircuitOpenError is returned, wrapped in a *url.Error by http.Client,
+// for requests which were not sent because the host's circuit is open.
+// Use errors.As() to detect it.
+type CircuitOpenError struct {
+	Host  string
+	Until time.Time // when trial requests will be let through
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+// CircuitBreaker is a RoundTripper which stops sending requests to a
+// host after several fail in a row, so callers fail fast rather than
+// each waiting out the timeouts.  After a cool-down, a trial request is
+// let through: if it succeeds the circuit closes, otherwise it stays open
+// for another cool-down.
+type CircuitBreaker struct {
+	base http.RoundTripper
+	conf BreakerConfig
+	now  func() time.Time
+
+	sync.Mutex
+	hosts map[string]*hostCircuit
+}
+
+type hostCircuit struct {
+	state    BreakerState
+	failures int
+	until    time.Time
+	trials   int
+}
+
+type stateChange struct {
+	host     string
+	from, to BreakerState
+}
+
+type requestOutcome int
+
+const (
+	outcomeSuccess requestOutcome = iota
+	outcomeFailure
+	outcomeIgnored
+)
+
+// NewCircuitBreaker returns a CircuitBreaker which sends requests through
+// base, keeping a circuit for each host.
+func NewCircuitBreaker(base http.RoundTripper, conf BreakerConfig) *CircuitBreaker {
+	conf.applyDefaults()
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &CircuitBreaker{
+		base:  base,
+		conf:  conf,
+		now:   time.Now,
+		hosts: map[string]*hostCircuit{},
+	}
+}
+
+// State returns the state of the circuit for host, which is the host and
+// port part of a request's URL.
+func (b *CircuitBreaker) State(host string) BreakerState {
+	b.Lock()
+	defer b.Unlock()
+	if hc, found := b.hosts[host]; found {
+		return hc.state
+	}
+	return BreakerClosed
+}
+
+func (b *CircuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := b.allow(host); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := b.base.RoundTrip(req)
+	b.record(host, b.outcome(req, resp, err))
+	return resp, err
+}
+
+// allow returns an error if a request to host must not be sent.
+func (b *CircuitBreaker) allow(host string) error {
+	var changes []stateChange
+	defer func() { b.notify(changes) }()
+
+	b.Lock()
+	defer b.Unlock()
+	hc, found := b.hosts[host]
+	if !found {
+		hc = &hostCircuit{}
+		b.hosts[host] = hc
+	}
+	switch hc.state {
+	case BreakerOpen:
+		if b.now().Before(hc.until) {
+			return &CircuitOpenError{Host: host, Until: hc.until}
+		}
+		changes = append(changes, b.setState(host, hc, BreakerHalfOpen))
+		hc.trials = 0
+		fallthrough
+	case BreakerHalfOpen:
+		if hc.trials >= b.conf.HalfOpenRequests {
+			return &CircuitOpenError{Host: host, Until: hc.until}
+		}
+		hc.trials++
+	}
+	return nil
+}
+
+// record updates the host's circuit with how a request went.
+func (b *CircuitBreaker) record(host string, outcome requestOutcome) {
+	var changes []stateChange
+	defer func() { b.notify(changes) }()
+
+	b.Lock()
+	defer b.Unlock()
+	hc := b.hosts[host]
+	switch hc.state {
+	case BreakerClosed:
+		switch outcome {
+		case outcomeSuccess:
+			hc.failures = 0
+		case outcomeFailure:
+			hc.failures++
+			if hc.failures >= b.conf.FailureThreshold {
+				changes = append(changes, b.open(host, hc))
+			}
+		}
+	case BreakerHalfOpen:
+		hc.trials--
+		switch outcome {
+		case outcomeSuccess:
+			hc.failures = 0
+			changes = append(changes, b.setState(host, hc, BreakerClosed))
+		case outcomeFailure:
+			changes = append(changes, b.open(host, hc))
+		}
+	case BreakerOpen:
+		// a request sent before the circuit opened.
+	}
+}
+
+func (b *CircuitBreaker) open(host string, hc *hostCircuit) stateChange {
+	hc.failures = 0
+	hc.until = b.now().Add(time.Duration(b.conf.CoolDownSeconds) * time.Second)
+	return b.setState(host, hc, BreakerOpen)
+}
+
+func (b *CircuitBreaker) setState(host string, hc *hostCircuit, state BreakerState) stateChange {
+	change := stateChange{host: host, from: hc.state, to: state}
+	hc.state = state
+	return change
+}
+
+// notify calls the callback without holding the lock, so it may use
+// State().
+func (b *CircuitBreaker) notify(changes []stateChange) {
+	if b.conf.OnStateChange == nil {
+		return
+	}
+	for _, c := range changes {
+		b.conf.OnStateChange(c.host, c.from, c.to)
+	}
+}
+
+func (b *CircuitBreaker) outcome(req *http.Request, resp *http.Response, err error) requestOutcome {
+	if err != nil {
+		if errors.Is(req.Context().Err(), context.Canceled) {
+			// the caller gave up, which says nothing about the host.  A
+			// deadline, including http.Client.Timeout, still counts as a
+			// failure, since a host which hangs is what the breaker is for.
+			return outcomeIgnored
+		}
+		return outcomeFailure
+	}
+	for _, code := range b.conf.FailureStatusCodes {
+		if resp.StatusCode == code {
+			return outcomeFailure
+		}
+	}
+	return outcomeSuccess
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var status int32 = http.StatusServiceUnavailable
+	var count int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	var changesLock sync.Mutex
+	changes := []string{}
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker(http.DefaultTransport, BreakerConfig{
+		FailureThreshold: 2,
+		CoolDownSeconds:  10,
+		OnStateChange: func(h string, from BreakerState, to BreakerState) {
+			changesLock.Lock()
+			defer changesLock.Unlock()
+			require.Equal(t, host, h)
+			changes = append(changes, from.String()+" -> "+to.String())
+		},
+	})
+	b.now = func() time.Time { return now }
+	client := &http.Client{Transport: b}
+
+	get := func() (int, error) {
+		resp, err := client.Get(s.URL)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// two failures open the circuit.
+	for i := 0; i < 2; i++ {
+		code, err := get()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusServiceUnavailable, code)
+	}
+	require.Equal(t, BreakerOpen, b.State(host))
+
+	// while open, requests fail without being sent.
+	_, err := get()
+	var open *CircuitOpenError
+	require.True(t, errors.As(err, &open))
+	require.Equal(t, host, open.Host)
+	require.Equal(t, now.Add(10*time.Second), open.Until)
+	require.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	// after the cool-down, a failed trial opens it again.
+	now = now.Add(11 * time.Second)
+	_, err = get()
+	require.NoError(t, err)
+	require.Equal(t, BreakerOpen, b.State(host))
+	require.Equal(t, int32(3), atomic.LoadInt32(&count))
+
+	// and a successful one closes it.
+	now = now.Add(11 * time.Second)
+	atomic.StoreInt32(&status, http.StatusOK)
+	code, err := get()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, BreakerClosed, b.State(host))
+
+	changesLock.Lock()
+	defer changesLock.Unlock()
+	require.Equal(t, []string{
+		"closed -> open",
+		"open -> half-open",
+		"half-open -> open",
+		"open -> half-open",
+		"half-open -> closed",
+	}, changes)
+}
+
+func TestCircuitBreaker_timeouts(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(s.Close)
+	t.Cleanup(func() { close(release) })
+	host := s.Listener.Addr().String()
+
+	b := NewCircuitBreaker(http.DefaultTransport, BreakerConfig{FailureThreshold: 2})
+	client := &http.Client{Transport: b, Timeout: 100 * time.Millisecond}
+
+	// requests which time out count as failures.
+	for i := 0; i < 2; i++ {
+		_, err := client.Get(s.URL)
+		require.Error(t, err)
+	}
+	require.Equal(t, BreakerOpen, b.State(host))
+
+	// but requests the caller cancels do not.
+	b2 := NewCircuitBreaker(http.DefaultTransport, BreakerConfig{FailureThreshold: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	require.NoError(t, err)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = (&http.Client{Transport: b2}).Do(req)
+	require.Error(t, err)
+	require.Equal(t, BreakerClosed, b2.State(host))
+}
+
+func TestCircuitBreaker_successResets(t *testing.T) {
+	b := NewCircuitBreaker(nil, BreakerConfig{FailureThreshold: 2})
+	require.NoError(t, b.allow("a"))
+	b.record("a", outcomeFailure)
+	require.NoError(t, b.allow("a"))
+	b.record("a", outcomeSuccess)
+	require.NoError(t, b.allow("a"))
+	b.record("a", outcomeFailure)
+	require.Equal(t, BreakerClosed, b.State("a"))
+
+	// hosts are independent.
+	require.NoError(t, b.allow("b"))
+	b.record("b", outcomeFailure)
+	require.NoError(t, b.allow("b"))
+	b.record("b", outcomeFailure)
+	require.Equal(t, BreakerOpen, b.State("b"))
+	require.Equal(t, BreakerClosed, b.State("a"))
+}
+
+func TestCircuitBreaker_halfOpenTrials(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker(nil, BreakerConfig{FailureThreshold: 1, CoolDownSeconds: 1, HalfOpenRequests: 2})
+	b.now = func() time.Time { return now }
+	require.NoError(t, b.allow("a"))
+	b.record("a", outcomeFailure)
+	require.Error(t, b.allow("a"))
+
+	now = now.Add(2 * time.Second)
+	require.NoError(t, b.allow("a"))
+	require.NoError(t, b.allow("a"))
+	require.Error(t, b.allow("a"))
+	require.Equal(t, BreakerHalfOpen, b.State("a"))
+
+	// an ignored trial frees its slot without closing the circuit.
+	b.record("a", outcomeIgnored)
+	require.Equal(t, BreakerHalfOpen, b.State("a"))
+	require.NoError(t, b.allow("a"))
+}
+
+func TestNewHTTPClient_circuitBreaker(t *testing.T) {
+	client := NewHTTPClient(WithCircuitBreaker(BreakerConfig{FailureThreshold: 1}), WithRetry(RetryConfig{}))
+	b, ok := client.Transport.(*CircuitBreaker)
+	require.True(t, ok)
+	_, ok = b.base.(*retryTransport)
+	require.True(t, ok)
+
+	// a request to an open circuit is not retried.
+	b.Lock()
+	b.hosts["example.com"] = &hostCircuit{state: BreakerOpen, until: time.Now().Add(time.Hour)}
+	b.Unlock()
+	_, err := client.Get("http://example.com/")
+	var urlErr *url.Error
+	require.True(t, errors.As(err, &urlErr))
+	var open *CircuitOpenError
+	require.True(t, errors.As(err, &open))
+}
@@ -31,6 +31,14 @@ type ClientConfig struct {
 	TLSHandshakeTimeout   int `json:"tlsHandshakeTimeout,omitempty" yaml:"tlsHandshakeTimeout,omitempty"`
 	ResponseHeaderTimeout int `json:"responseHeaderTimeout,omitempty" yaml:"responseHeaderTimeout,omitempty"`
 	MaxIdleConnections    int `json:"maxIdleConnections,omitempty" yaml:"maxIdleConnections,omitempty"`
+
+	// Retry, if set, makes clients retry failed requests.  See
+	// NewRetryTransport().  ClientTimeout covers all the attempts.
+	Retry *RetryConfig `json:"retry,omitempty" yaml:"retry,omitempty"`
+
+	// CircuitBreaker, if set, makes clients fail fast when a host keeps
+	// failing.  See NewCircuitBreaker().
+	CircuitBreaker *BreakerConfig `json:"circuitBreaker,omitempty" yaml:"circuitBreaker,omitempty"`
 }
 
 var defaultTLSConfig *tls.Config
@@ -59,10 +67,21 @@ func (c *ClientConfig) applyDefaults() {
 	if c.MaxIdleConnections == 0 {
 		c.MaxIdleConnections = defaultClientConfig.MaxIdleConnections
 	}
+	if c.Retry != nil {
+		retry := *c.Retry
+		retry.applyDefaults()
+		c.Retry = &retry
+	}
+	if c.CircuitBreaker != nil {
+		breaker := *c.CircuitBreaker
+		breaker.applyDefaults()
+		c.CircuitBreaker = &breaker
+	}
 }
 
 // SetClientConfig will replace the current clientConfig for all future clients
-// returned by NewHTTPClient().  Generally, this will be set once, and probably
+// returned by NewHTTPClient(), unless they are given WithClientConfig() or
+// WithTimeouts().  Generally, this will be set once, and probably
 // not changed per connection.  It is not going to be thread-safe, in that
 // setting the config and then calling NewHTTPClient() could be a race.
 func SetClientConfig(c ClientConfig) {
@@ -77,39 +96,64 @@ func SetClientConfig(c ClientConfig) {
 // This will generally be set once for adding custom CA roots or other
 // configuration used throughout the application.
 //
-// NewHTTPClient() also allows per-client TLS configuration, if desired.
+// WithTLS() allows per-client TLS configuration, if desired.
 func SetTLSConfig(tlsconfig *tls.Config) {
 	defaultTLSConfig = tlsconfig
 }
 
+// DefaultTLSConfig returns a copy of the TLS configuration set with
+// SetTLSConfig(), or nil if none was set.  It is meant as a base for a
+// per-client configuration passed to WithTLS(), which replaces it.
+func DefaultTLSConfig() *tls.Config {
+	if defaultTLSConfig == nil {
+		return nil
+	}
+	return defaultTLSConfig.Clone()
+}
+
 // NewHTTPClient returns a new http.Client that is configured with
-// sane timeouts, a global TLS configuration, and optionally a per-client
-// TLS config.
+// sane timeouts and the global TLS configuration, as changed by the
+// options given.
 //
 // Generally, the global config will have things like custom CA roots,
 // and we will want to trust those for every outgoing conneciton.
-// A per-client TLS config would be used where we are talking to a
-// specific API, and want to insert our certificates or a custom
-// CA root for just that connection.
+// A per-client TLS config, set with WithTLS(), would be used where we are
+// talking to a specific API, and want to insert our certificates or a
+// custom CA root for just that connection.
 //
 // Future changes should allow merging tls configs, so we can add to
 // the base default rather than replace it entirely.
-func NewHTTPClient(tlsConfig *tls.Config) *http.Client {
-	if tlsConfig == nil {
-		tlsConfig = defaultTLSConfig
+func NewHTTPClient(opts ...ClientOption) *http.Client {
+	o := newClientOptions()
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+
+	dialer := net.Dialer{Timeout: o.dialTimeout}
+	var transport http.RoundTripper = otelhttp.NewTransport(&http.Transport{
+		Proxy:                 o.proxy,
+		Dial:                  dialer.Dial,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   o.tlsHandshakeTimeout,
+		TLSClientConfig:       o.tlsConfig,
+		ResponseHeaderTimeout: o.responseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          o.maxIdleConnections,
+	})
+	if o.retry != nil {
+		transport = NewRetryTransport(transport, *o.retry)
+	}
+	if o.breaker != nil {
+		transport = NewCircuitBreaker(transport, *o.breaker)
+	}
+	for _, wrap := range o.wrappers {
+		transport = wrap(transport)
 	}
-	dialer := net.Dialer{Timeout: time.Duration(defaultClientConfig.DialTimeout) * time.Second}
 	client := &http.Client{
-		Timeout: time.Duration(defaultClientConfig.ClientTimeout) * time.Second,
-		Transport: otelhttp.NewTransport(&http.Transport{
-			Dial:                  dialer.Dial,
-			DialContext:           dialer.DialContext,
-			TLSHandshakeTimeout:   time.Duration(defaultClientConfig.TLSHandshakeTimeout) * time.Second,
-			TLSClientConfig:       tlsConfig,
-			ResponseHeaderTimeout: time.Duration(defaultClientConfig.ResponseHeaderTimeout) * time.Second,
-			ExpectContinueTimeout: time.Second,
-			MaxIdleConns:          defaultClientConfig.MaxIdleConnections,
-		}),
+		Timeout:   o.clientTimeout,
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
@@ -132,3 +132,17 @@ func Test_SetTLSConfig(t *testing.T) {
 		require.NotNil(t, defaultTLSConfig)
 	})
 }
+
+func Test_DefaultTLSConfig(t *testing.T) {
+	saved := defaultTLSConfig
+	t.Cleanup(func() { defaultTLSConfig = saved })
+
+	SetTLSConfig(nil)
+	require.Nil(t, DefaultTLSConfig())
+
+	c := &tls.Config{ServerName: "global"}
+	SetTLSConfig(c)
+	got := DefaultTLSConfig()
+	require.Equal(t, "global", got.ServerName)
+	require.NotSame(t, c, got)
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientOption changes how NewHTTPClient() builds a client.  Anything not
+// set by an option comes from SetClientConfig() and SetTLSConfig().
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	dialTimeout           time.Duration
+	clientTimeout         time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	maxIdleConnections    int
+	retry                 *RetryConfig
+	breaker               *BreakerConfig
+	tlsConfig             *tls.Config
+	proxy                 func(*http.Request) (*url.URL, error)
+	wrappers              []func(http.RoundTripper) http.RoundTripper
+}
+
+func newClientOptions() *clientOptions {
+	o := &clientOptions{tlsConfig: defaultTLSConfig}
+	o.setClientConfig(*defaultClientConfig)
+	return o
+}
+
+func (o *clientOptions) setClientConfig(c ClientConfig) {
+	c.applyDefaults()
+	o.dialTimeout = time.Duration(c.DialTimeout) * time.Second
+	o.clientTimeout = time.Duration(c.ClientTimeout) * time.Second
+	o.tlsHandshakeTimeout = time.Duration(c.TLSHandshakeTimeout) * time.Second
+	o.responseHeaderTimeout = time.Duration(c.ResponseHeaderTimeout) * time.Second
+	o.maxIdleConnections = c.MaxIdleConnections
+	o.retry = c.Retry
+	o.breaker = c.CircuitBreaker
+}
+
+// WithClientConfig uses c instead of the config set with
+// SetClientConfig().  As there, zero values are replaced by defaults.
+func WithClientConfig(c ClientConfig) ClientOption {
+	return func(o *clientOptions) {
+		o.setClientConfig(c)
+	}
+}
+
+// Timeouts are the client's timeouts.  If 0, the current setting is kept.
+type Timeouts struct {
+	Dial           time.Duration
+	Client         time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+}
+
+// WithTimeouts changes the timeouts which are set in t.
+func WithTimeouts(t Timeouts) ClientOption {
+	return func(o *clientOptions) {
+		if t.Dial != 0 {
+			o.dialTimeout = t.Dial
+		}
+		if t.Client != 0 {
+			o.clientTimeout = t.Client
+		}
+		if t.TLSHandshake != 0 {
+			o.tlsHandshakeTimeout = t.TLSHandshake
+		}
+		if t.ResponseHeader != 0 {
+			o.responseHeaderTimeout = t.ResponseHeader
+		}
+	}
+}
+
+// WithRetry makes the client retry failed requests.  See
+// NewRetryTransport().
+func WithRetry(c RetryConfig) ClientOption {
+	return func(o *clientOptions) {
+		o.retry = &c
+	}
+}
+
+// WithCircuitBreaker makes the client fail fast when a host keeps
+// failing.  See NewCircuitBreaker().  It wraps any retries, so a request
+// counts as failed only if all its attempts do.
+func WithCircuitBreaker(c BreakerConfig) ClientOption {
+	return func(o *clientOptions) {
+		o.breaker = &c
+	}
+}
+
+// WithTLS uses tlsConfig instead of the one set with SetTLSConfig().  If
+// nil, the global one is still used.
+func WithTLS(tlsConfig *tls.Config) ClientOption {
+	return func(o *clientOptions) {
+		if tlsConfig != nil {
+			o.tlsConfig = tlsConfig
+		}
+	}
+}
+
+// WithProxy sets the proxy for requests, as for http.Transport.Proxy.
+// Use http.ProxyFromEnvironment to follow the usual environment variables.
+// By default, no proxy is used.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.proxy = proxy
+	}
+}
+
+// WithTransportWrapper wraps the client's transport, for example to add
+// headers or logging.  Wrappers are applied in order, so the last one
+// given sees each request first.  They wrap any retries, so see each
+// request once.
+func WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) ClientOption {
+	return func(o *clientOptions) {
+		o.wrappers = append(o.wrappers, wrap)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientOptions(t *testing.T) {
+	savedConfig, savedTLS := *defaultClientConfig, defaultTLSConfig
+	t.Cleanup(func() {
+		*defaultClientConfig = savedConfig
+		defaultTLSConfig = savedTLS
+	})
+	SetClientConfig(ClientConfig{DialTimeout: 7})
+	globalTLS := &tls.Config{ServerName: "global"}
+	SetTLSConfig(globalTLS)
+
+	t.Run("globals are defaults", func(t *testing.T) {
+		o := newClientOptions()
+		require.Equal(t, 7*time.Second, o.dialTimeout)
+		require.Equal(t, time.Duration(defaultClientConfig.ClientTimeout)*time.Second, o.clientTimeout)
+		require.Same(t, globalTLS, o.tlsConfig)
+		require.Nil(t, o.retry)
+	})
+
+	t.Run("options override", func(t *testing.T) {
+		o := newClientOptions()
+		clientTLS := &tls.Config{ServerName: "client"}
+		for _, opt := range []ClientOption{
+			WithTimeouts(Timeouts{Client: 1500 * time.Millisecond}),
+			WithTLS(clientTLS),
+			WithRetry(RetryConfig{MaxRetries: 9}),
+		} {
+			opt(o)
+		}
+		require.Equal(t, 7*time.Second, o.dialTimeout)
+		require.Equal(t, 1500*time.Millisecond, o.clientTimeout)
+		require.Same(t, clientTLS, o.tlsConfig)
+		require.Equal(t, 9, o.retry.MaxRetries)
+
+		WithTLS(nil)(o)
+		require.Same(t, clientTLS, o.tlsConfig)
+	})
+
+	t.Run("client config", func(t *testing.T) {
+		o := newClientOptions()
+		WithClientConfig(ClientConfig{DialTimeout: 3, MaxIdleConnections: 2})(o)
+		require.Equal(t, 3*time.Second, o.dialTimeout)
+		require.Equal(t, 2, o.maxIdleConnections)
+		require.Equal(t, time.Duration(defaultClientConfig.TLSHandshakeTimeout)*time.Second, o.tlsHandshakeTimeout)
+	})
+
+	t.Run("client timeout", func(t *testing.T) {
+		client := NewHTTPClient(WithTimeouts(Timeouts{Client: time.Second}))
+		require.Equal(t, time.Second, client.Timeout)
+		require.Equal(t, time.Duration(defaultClientConfig.ClientTimeout)*time.Second, NewHTTPClient().Timeout)
+	})
+}
+
+type headerTransport struct {
+	base  http.RoundTripper
+	value string
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Add("x-test", t.value)
+	return t.base.RoundTrip(req)
+}
+
+func TestNewHTTPClient_wrappersAndProxy(t *testing.T) {
+	var proxied *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	client := NewHTTPClient(
+		WithProxy(http.ProxyURL(proxyURL)),
+		WithTransportWrapper(func(rt http.RoundTripper) http.RoundTripper { return headerTransport{rt, "inner"} }),
+		WithTransportWrapper(func(rt http.RoundTripper) http.RoundTripper { return headerTransport{rt, "outer"} }),
+	)
+	resp, err := client.Get("http://service.example.com/path")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.NotNil(t, proxied)
+	require.Equal(t, "service.example.com", proxied.Host)
+	require.Equal(t, []string{"outer", "inner"}, proxied.Header.Values("x-test"))
+}
@@ -0,0 +1,270 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryConfig configures retrying of failed requests.  Zero values are
+// replaced by defaults.
+type RetryConfig struct {
+	MaxRetries           int     `json:"maxRetries,omitempty" yaml:"maxRetries,omitempty"`
+	MinBackoffMillis     int     `json:"minBackoffMillis,omitempty" yaml:"minBackoffMillis,omitempty"`
+	MaxBackoffMillis     int     `json:"maxBackoffMillis,omitempty" yaml:"maxBackoffMillis,omitempty"`
+	MaxRetryAfterSeconds int     `json:"maxRetryAfterSeconds,omitempty" yaml:"maxRetryAfterSeconds,omitempty"`
+	RetryStatusCodes     []int   `json:"retryStatusCodes,omitempty" yaml:"retryStatusCodes,omitempty"`
+	BudgetRatio          float64 `json:"budgetRatio,omitempty" yaml:"budgetRatio,omitempty"`
+	BudgetMaxRetries     int     `json:"budgetMaxRetries,omitempty" yaml:"budgetMaxRetries,omitempty"`
+}
+
+var defaultRetryConfig = RetryConfig{
+	MaxRetries:           3,
+	MinBackoffMillis:     100,
+	MaxBackoffMillis:     10000,
+	MaxRetryAfterSeconds: 60,
+	RetryStatusCodes:     []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	BudgetRatio:          0.1,
+	BudgetMaxRetries:     10,
+}
+
+func (c *RetryConfig) applyDefaults() {
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultRetryConfig.MaxRetries
+	}
+	if c.MinBackoffMillis == 0 {
+		c.MinBackoffMillis = defaultRetryConfig.MinBackoffMillis
+	}
+	if c.MaxBackoffMillis == 0 {
+		c.MaxBackoffMillis = defaultRetryConfig.MaxBackoffMillis
+	}
+	if c.MaxBackoffMillis < c.MinBackoffMillis {
+		c.MaxBackoffMillis = c.MinBackoffMillis
+	}
+	if c.MaxRetryAfterSeconds == 0 {
+		c.MaxRetryAfterSeconds = defaultRetryConfig.MaxRetryAfterSeconds
+	}
+	if len(c.RetryStatusCodes) == 0 {
+		c.RetryStatusCodes = append([]int{}, defaultRetryConfig.RetryStatusCodes...)
+	}
+	if c.BudgetRatio == 0 {
+		c.BudgetRatio = defaultRetryConfig.BudgetRatio
+	}
+	if c.BudgetMaxRetries == 0 {
+		c.BudgetMaxRetries = defaultRetryConfig.BudgetMaxRetries
+	}
+}
+
+// retryTransport retries requests which fail with a transient error or
+// one of the configured status codes.
+type retryTransport struct {
+	base   http.RoundTripper
+	conf   RetryConfig
+	budget *retryBudget
+}
+
+// NewRetryTransport returns a RoundTripper which retries requests sent
+// through base, waiting with exponential backoff and jitter between
+// attempts, or for as long as a Retry-After header asks if that is no more
+// than MaxRetryAfterSeconds.
+//
+// Only idempotent requests are retried after they may have reached the
+// server: GET, HEAD, OPTIONS, TRACE, PUT and DELETE, and any request with
+// an Idempotency-Key or X-Idempotency-Key header.  Other requests are
+// retried only if the connection could not be made.  A request with a
+// body is retried only if it has GetBody, which http.NewRequest() sets
+// for the common body types.
+//
+// Retries are limited by a budget shared by all requests through the
+// transport: each request adds BudgetRatio to it, up to BudgetMaxRetries,
+// and each retry takes one.  This keeps a failing server from seeing
+// MaxRetries times its usual load.
+func NewRetryTransport(base http.RoundTripper, conf RetryConfig) http.RoundTripper {
+	conf.applyDefaults()
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{
+		base:   base,
+		conf:   conf,
+		budget: newRetryBudget(conf.BudgetRatio, conf.BudgetMaxRetries),
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.budget.deposit()
+	rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(attemptReq)
+		if attempt >= t.conf.MaxRetries || !rewindable || !t.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		delay := t.backoff(attempt)
+		if resp != nil {
+			retryAfter, ok := parseRetryAfter(resp.Header.Get("retry-after"), time.Now())
+			if ok {
+				if retryAfter > time.Duration(t.conf.MaxRetryAfterSeconds)*time.Second {
+					return resp, err
+				}
+				delay = retryAfter
+			}
+		}
+		if !t.budget.withdraw() {
+			return resp, err
+		}
+		if resp != nil {
+			drainBody(resp.Body)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		attemptReq = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+	}
+}
+
+func (t *retryTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		var open *CircuitOpenError
+		if errors.As(err, &open) {
+			return false
+		}
+		return isDialError(err) || isIdempotent(req)
+	}
+	if !isIdempotent(req) {
+		return false
+	}
+	for _, code := range t.conf.RetryStatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait before the retry following the given
+// attempt, between half and all of the exponential delay.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	min := time.Duration(t.conf.MinBackoffMillis) * time.Millisecond
+	max := time.Duration(t.conf.MaxBackoffMillis) * time.Millisecond
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// isDialError returns true if the request was never sent because a
+// connection could not be made.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	when, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	d := when.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// drainBody reads a little of an unwanted response body so the connection
+// can be reused, and closes it.
+func drainBody(body io.ReadCloser) {
+	_, _ = io.CopyN(io.Discard, body, 4096)
+	body.Close()
+}
+
+type retryBudget struct {
+	sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64, max int) *retryBudget {
+	return &retryBudget{ratio: ratio, max: float64(max), tokens: float64(max)}
+}
+
+func (b *retryBudget) deposit() {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
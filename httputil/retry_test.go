@@ -0,0 +1,226 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newFlakyServer fails the first failures requests with status, and
+// records the bodies it was sent.
+func newFlakyServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *int32, chan string) {
+	t.Helper()
+	var count int32
+	bodies := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		if atomic.AddInt32(&count, 1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(s.Close)
+	return s, &count, bodies
+}
+
+func testRetryClient(conf RetryConfig) *http.Client {
+	return &http.Client{Transport: NewRetryTransport(http.DefaultTransport, conf)}
+}
+
+func TestRetryTransport_retriesStatus(t *testing.T) {
+	s, count, _ := newFlakyServer(t, 2, http.StatusServiceUnavailable, nil)
+	client := testRetryClient(RetryConfig{MinBackoffMillis: 1, MaxBackoffMillis: 2})
+
+	resp, err := client.Get(s.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(3), atomic.LoadInt32(count))
+}
+
+func TestRetryTransport_givesUp(t *testing.T) {
+	s, count, _ := newFlakyServer(t, 10, http.StatusBadGateway, nil)
+	client := testRetryClient(RetryConfig{MaxRetries: 2, MinBackoffMillis: 1, MaxBackoffMillis: 2})
+
+	resp, err := client.Get(s.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.Equal(t, int32(3), atomic.LoadInt32(count))
+}
+
+func TestRetryTransport_notRetriedStatus(t *testing.T) {
+	s, count, _ := newFlakyServer(t, 1, http.StatusInternalServerError, nil)
+	client := testRetryClient(RetryConfig{MinBackoffMillis: 1, MaxBackoffMillis: 2})
+
+	resp, err := client.Get(s.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(count))
+}
+
+func TestRetryTransport_idempotency(t *testing.T) {
+	s, count, bodies := newFlakyServer(t, 1, http.StatusServiceUnavailable, nil)
+	client := testRetryClient(RetryConfig{MinBackoffMillis: 1, MaxBackoffMillis: 2})
+
+	// POST is not retried after reaching the server...
+	resp, err := client.Post(s.URL, "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(count))
+	require.Equal(t, "hello", <-bodies)
+
+	// ...unless it has an idempotency key, and the body is sent again.
+	atomic.StoreInt32(count, 0)
+	req, err := http.NewRequest(http.MethodPost, s.URL, strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.Header.Set("Idempotency-Key", "abc")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello", <-bodies)
+	require.Equal(t, "hello", <-bodies)
+}
+
+func TestRetryTransport_noGetBody(t *testing.T) {
+	s, count, _ := newFlakyServer(t, 1, http.StatusServiceUnavailable, nil)
+	client := testRetryClient(RetryConfig{MinBackoffMillis: 1, MaxBackoffMillis: 2})
+
+	req, err := http.NewRequest(http.MethodPut, s.URL, io.NopCloser(strings.NewReader("hello")))
+	require.NoError(t, err)
+	require.Nil(t, req.GetBody)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(count))
+}
+
+func TestRetryTransport_retryAfter(t *testing.T) {
+	s, count, _ := newFlakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}})
+	client := testRetryClient(RetryConfig{MinBackoffMillis: 1, MaxBackoffMillis: 2})
+
+	start := time.Now()
+	resp, err := client.Get(s.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(count))
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// a Retry-After longer than allowed is returned to the caller.
+	s, count, _ = newFlakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"120"}})
+	resp, err = client.Get(s.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(count))
+}
+
+func TestRetryTransport_contextCancelled(t *testing.T) {
+	s, count, _ := newFlakyServer(t, 10, http.StatusServiceUnavailable, nil)
+	client := testRetryClient(RetryConfig{MinBackoffMillis: 10000, MaxBackoffMillis: 10000})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, int32(1), atomic.LoadInt32(count))
+}
+
+func TestRetryTransport_dialError(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	url := s.URL
+	s.Close()
+	client := testRetryClient(RetryConfig{MaxRetries: 2, MinBackoffMillis: 1, MaxBackoffMillis: 2})
+
+	// the request was never sent, so even a POST is retried.
+	rt := client.Transport.(*retryTransport)
+	_, err := client.Post(url, "text/plain", strings.NewReader("hello"))
+	require.Error(t, err)
+	require.Equal(t, float64(rt.conf.BudgetMaxRetries-2), rt.budget.tokens)
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5, 2)
+	require.True(t, b.withdraw())
+	require.True(t, b.withdraw())
+	require.False(t, b.withdraw())
+	b.deposit()
+	require.False(t, b.withdraw())
+	b.deposit()
+	require.True(t, b.withdraw())
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	require.Equal(t, float64(2), b.tokens)
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"Sat, 01 Jan 2022 00:00:30 GMT", 30 * time.Second, true},
+		{"Fri, 31 Dec 2021 00:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNewHTTPClient_retry(t *testing.T) {
+	saved := *defaultClientConfig
+	t.Cleanup(func() { *defaultClientConfig = saved })
+
+	SetClientConfig(ClientConfig{})
+	_, retrying := NewHTTPClient().Transport.(*retryTransport)
+	require.False(t, retrying)
+
+	SetClientConfig(ClientConfig{Retry: &RetryConfig{MaxRetries: 5}})
+	rt, retrying := NewHTTPClient().Transport.(*retryTransport)
+	require.True(t, retrying)
+	require.Equal(t, 5, rt.conf.MaxRetries)
+	require.Equal(t, defaultRetryConfig.MinBackoffMillis, rt.conf.MinBackoffMillis)
+}
@@ -44,8 +44,8 @@ func (sse *SSE) AutoFlush(af bool) {
 	sse.autoFlush = af
 }
 
-// Read will return an event, which may be empty if nothing but a keep-alive was
-// received thus far.  The boolean flag indicates EOF.  If true, no more reads should
+// Read will return an event, which may be empty if nothing but a keep-alive or
+// other comment was received thus far.  The boolean flag indicates EOF.  If true, no more reads should
 // be performed on this SSE.
 func (sse *SSE) Read() (Event, bool) {
 	ret := Event{}
@@ -58,19 +58,21 @@ func (sse *SSE) Read() (Event, bool) {
 			}
 			continue
 		}
-		if line == ":" {
+		if strings.HasPrefix(line, ":") {
+			// a comment, such as a keep-alive, is not part of an event.
 			if len(ret) == 0 {
 				return ret, false
 			}
 			continue
 		}
-		parts := strings.SplitN(line, ":", 2)
-		current := ret[parts[0]]
+		// a line without a colon is a field with an empty value.
+		field, value, _ := strings.Cut(line, ":")
+		current := ret[field]
 		if current != "" {
 			current = current + "\n"
 		}
-		current = current + strings.TrimSpace(parts[1])
-		ret[parts[0]] = current
+		current = current + strings.TrimSpace(value)
+		ret[field] = current
 	}
 	return Event{}, true
 }
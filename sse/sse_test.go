@@ -58,6 +58,30 @@ func TestSSE_Read(t *testing.T) {
 			Event{"data": "foo\nbar"},
 			false,
 		},
+		{
+			"comment",
+			": ping\n",
+			Event{},
+			false,
+		},
+		{
+			"data with comments",
+			"data: foo\n: ping\n\n",
+			Event{"data": "foo"},
+			false,
+		},
+		{
+			"field without a colon",
+			"data\n\n",
+			Event{"data": ""},
+			false,
+		},
+		{
+			"field without a colon after data",
+			"event: foo\nid\n\n",
+			Event{"event": "foo", "id": ""},
+			false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {